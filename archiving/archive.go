@@ -1,6 +1,9 @@
 package archiving
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -10,28 +13,124 @@ import (
 	"github.com/rokeller/bart/crypto"
 	"github.com/rokeller/bart/domain"
 	"github.com/rokeller/bart/settings"
+	"github.com/rokeller/bart/throttling"
 )
 
 type Archive struct {
 	localContext    LocalContext
 	storageProvider StorageProvider
+	options         Options
 	settings        settings.Settings
 	cryptoContext   crypto.AesOfbContext
 	index           *Index
+	lock            Lock
+}
+
+// defaultIndexGenerations is the number of generations kept of each index shard
+// by default.
+const defaultIndexGenerations = 3
+
+// Options holds optional settings for an archive.
+type Options struct {
+	// UploadLimiter limits the bandwidth used to upload backup files; nil
+	// means no limit.
+	UploadLimiter *throttling.Limiter
+	// DownloadLimiter limits the bandwidth used to download backup files for
+	// restore; nil means no limit.
+	DownloadLimiter *throttling.Limiter
+	// Exclusive determines if the archive is locked for exclusive access,
+	// which is needed by all commands modifying the archive.
+	Exclusive bool
+	// IndexCacheDir is the directory in which index shards are cached locally;
+	// empty disables the cache.
+	IndexCacheDir string
+	// Checkpoints defines when checkpoints of the index are uploaded while it
+	// changes.
+	Checkpoints CheckpointPolicy
+	// IndexGenerations is the number of generations kept of each index shard,
+	// so that the previous generations can be used when the newest one is
+	// corrupt. Values below 1 mean the default of 3 generations.
+	IndexGenerations int
+	// RebuildIndex starts with an empty index that replaces the index in the
+	// backup destination when it is written, instead of reading the index.
+	RebuildIndex bool
+	// RememberRoots stores the named roots of the local context with their
+	// directories in the archive, in addition to the roots stored before. It
+	// needs exclusive access.
+	RememberRoots bool
+	// RestoreRememberedRoots maps the roots stored in the archive, which the
+	// local context doesn't map, to the directories they were backed up from.
+	RestoreRememberedRoots bool
+	// Exit exits the process with the message of a fatal error, once the lock
+	// of the archive is released; nil means glog.Exit.
+	Exit func(message string)
+}
+
+// indexGenerations determines the number of generations to keep of each index
+// shard.
+func (o Options) indexGenerations() int {
+	if o.IndexGenerations < 1 {
+		return defaultIndexGenerations
+	}
+
+	return o.IndexGenerations
+}
+
+// CheckpointPolicy defines when checkpoints of the index are uploaded, so that
+// the progress of long running commands is not lost when they are aborted. A
+// checkpoint is uploaded as soon as any of the (non-zero) limits is reached.
+// When all limits are zero, checkpoints are disabled; the index is still
+// uploaded when the archive is closed.
+type CheckpointPolicy struct {
+	// Interval is the time between checkpoints.
+	Interval time.Duration
+	// Entries is the number of changed index entries after which a checkpoint
+	// is uploaded.
+	Entries int64
+	// Bytes is the number of bytes backed up after which a checkpoint is
+	// uploaded.
+	Bytes int64
 }
 
 // NewArchive creates a new archive.
-func NewArchive(password string, localContext LocalContext, storageProvider StorageProvider) Archive {
+func NewArchive(
+	password string,
+	localContext LocalContext,
+	storageProvider StorageProvider,
+	options Options,
+) Archive {
 	a := Archive{
 		localContext:    localContext,
 		storageProvider: storageProvider,
-		settings:        loadSettings(storageProvider),
+		options:         options,
+	}
+
+	if options.Exclusive {
+		a.lock = a.acquireLock()
 	}
 
+	isNew := a.loadSettings()
+
 	a.cryptoContext = crypto.NewAesOfbContext(password, a.settings)
+	a.verifyKey(isNew)
 	a.index = newIndex(&a)
 	glog.Infof("The archive index currently has %d file(s).", a.index.Count())
 
+	// Reading the index proves the password right, so archives created by
+	// earlier versions can get the key check. Only commands modifying the
+	// archive do so, to not have concurrent writes of the settings.
+	if nil == a.settings.KeyCheck() && options.Exclusive && a.index.Count() > 0 {
+		glog.Info("Adding the key check to the archive settings.")
+		a.storeKeyCheck()
+	}
+
+	if options.RestoreRememberedRoots {
+		a.localContext = a.localContext.withDefaultRoots(a.rememberedRoots())
+	}
+	if options.RememberRoots && options.Exclusive {
+		a.rememberRoots()
+	}
+
 	return a
 }
 
@@ -45,9 +144,10 @@ func (a Archive) NeedsBackup(entry domain.Entry) bool {
 func (a Archive) GetEntry(relPath string) *domain.Entry {
 	idxEntry := a.index.getEntry(relPath)
 	if nil == idxEntry ||
-		(idxEntry.EntryFlags&EntryFlagsPresentInBackup) == EntryFlagsNone {
+		(idxEntry.EntryFlags&EntryFlagsPresentInBackup) == EntryFlagsNone ||
+		0 != idxEntry.TrashTime {
 		// Either there is no entry at all, or the entry does not track an file
-		// that is present in the backup.
+		// that is present in the backup (outside of the trash).
 		return nil
 	}
 
@@ -57,9 +157,18 @@ func (a Archive) GetEntry(relPath string) *domain.Entry {
 	}
 }
 
+// AbsPath determines the local path of the file with the given relative path.
+// It returns false when the file's root is not mapped to a local directory.
+func (a Archive) AbsPath(relPath string) (string, bool) {
+	return a.localContext.AbsPath(relPath)
+}
+
 // Backup backs up the given entry.
 func (a Archive) Backup(entry domain.Entry) error {
-	absPath := path.Join(a.localContext.rootDir, entry.RelPath)
+	absPath, found := a.localContext.AbsPath(entry.RelPath)
+	if !found {
+		return RootNotMapped
+	}
 
 	// Open the local file ...
 	src, err := os.Open(absPath)
@@ -69,6 +178,19 @@ func (a Archive) Backup(entry domain.Entry) error {
 	}
 	defer src.Close()
 
+	return a.backup(entry, src, EntryFlagsPresentInBackup|EntryFlagsPresentInLocal)
+}
+
+// BackupStream backs up the content of the given reader, e.g. stdin, as the
+// given entry. The entry is marked as a stream, so it is neither restored nor
+// cleaned up for lack of a local file.
+func (a Archive) BackupStream(entry domain.Entry, r io.Reader) error {
+	entry.Stream = true
+	return a.backup(entry, r, EntryFlagsPresentInBackup)
+}
+
+func (a Archive) backup(entry domain.Entry, src io.Reader, flags EntryFlags) error {
+	entry.BlobID = entry.Hash()
 	w, err := a.newBackupFile(entry)
 	if nil != err {
 		glog.Errorf("Failed to create temporary file: %v", err)
@@ -83,55 +205,118 @@ func (a Archive) Backup(entry domain.Entry) error {
 	}
 	defer cw.Close()
 
-	// ... and copy it to the archive writer.
-	if _, err = io.Copy(cw, src); err != nil {
+	// The header allows rebuilding the index from the backup files.
+	entry.BackupTime = time.Now().Unix()
+	if err := writeBlobHeader(cw, entry); nil != err {
+		glog.Errorf("Failed to write backup file header: %v", err)
+		return err
+	}
+
+	// ... and copy it to the archive writer, calculating the digest on the
+	// way.
+	digest := sha256.New()
+	n, err := io.Copy(cw, io.TeeReader(src, digest))
+	if err != nil {
 		glog.Errorf("Failed to write to backup: %v", err)
 		return err
 	}
 
-	if err := w.Upload(); nil != err {
+	// The trailer allows rebuilding the index with the size and digest.
+	entry.Size = n
+	entry.Digest = digest.Sum(nil)
+	if err := writeBlobTrailer(cw, entry.Size, entry.Digest); nil != err {
+		glog.Errorf("Failed to write backup file trailer: %v", err)
 		return err
 	}
 
-	a.index.setEntry(entry, EntryFlagsPresentInBackup|EntryFlagsPresentInLocal, true)
+	storedSize, err := w.Upload()
+	if nil != err {
+		return err
+	}
+
+	entry.StoredSize = storedSize
+
+	a.index.trackBackedUpBytes(n)
+	a.index.setEntry(entry, flags, true)
 
 	return nil
 }
 
 // Restore restores the given entry.
 func (a Archive) Restore(entry domain.Entry) error {
-	relDir := path.Dir(entry.RelPath)
-	restoreDir := path.Join(a.localContext.rootDir, relDir)
-	restorePath := path.Join(a.localContext.rootDir, entry.RelPath)
+	restorePath, found := a.localContext.AbsPath(entry.RelPath)
+	if !found {
+		return RootNotMapped
+	}
+	restoreDir := path.Dir(restorePath)
 
 	if err := os.MkdirAll(restoreDir, 0700); nil != err {
 		return err
 	}
 
+	outfile, err := os.Create(restorePath)
+	if nil != err {
+		return err
+	}
+	defer outfile.Close()
+
+	if err := a.Extract(entry, outfile); nil != err {
+		// Don't leave a corrupt file behind, or it won't be restored again.
+		outfile.Close()
+		os.Remove(restorePath)
+		return err
+	}
+
+	// Restore the timestamps to be the ones from the backup index metadata.
+	ts := time.Unix(entry.Timestamp, 0)
+	return os.Chtimes(restorePath, ts, ts)
+}
+
+// Extract decrypts the backup file of the given entry and writes its content to
+// the given writer. It fails with DigestMismatch when the content doesn't match
+// the digest of the entry, after all of it has been written.
+func (a Archive) Extract(entry domain.Entry, w io.Writer) error {
 	r, err := a.storageProvider.ReadBackupFile(entry)
 	if nil != err {
 		return err
 	}
 	defer r.Close()
 
-	cr, err := a.cryptoContext.Decrypt(r)
+	cr, err := a.cryptoContext.Decrypt(throttling.NewReader(r, a.options.DownloadLimiter))
 	if nil != err {
 		return err
 	}
 
-	outfile, err := os.Create(restorePath)
+	// Skip the header; backup files from earlier versions don't have one.
+	_, content, err := readBlobHeader(cr)
 	if nil != err {
 		return err
 	}
-	defer outfile.Close()
 
-	if _, err = io.Copy(outfile, cr); err != nil {
+	digest := sha256.New()
+	if _, err = io.Copy(w, io.TeeReader(content, digest)); err != nil {
 		return err
 	}
 
-	// Restore the timestamps to be the ones from the backup index metadata.
-	ts := time.Unix(entry.Timestamp, 0)
-	return os.Chtimes(restorePath, ts, ts)
+	// Entries backed up by earlier versions don't have a digest.
+	if len(entry.Digest) > 0 && !bytes.Equal(entry.Digest, digest.Sum(nil)) {
+		return DigestMismatch
+	}
+
+	return nil
+}
+
+// Trash moves the given entry to the trash. Its backup file is kept until it is
+// deleted when emptying the trash.
+func (a Archive) Trash(entry domain.Entry) {
+	entry.TrashTime = time.Now().Unix()
+	a.index.setEntry(entry, EntryFlagsPresentInBackup, true)
+}
+
+// Untrash moves the given entry out of the trash, back into the backup.
+func (a Archive) Untrash(entry domain.Entry) {
+	entry.TrashTime = 0
+	a.index.setEntry(entry, EntryFlagsPresentInBackup, true)
 }
 
 // Delete deletes the given entry from the backup.
@@ -144,12 +329,107 @@ func (a Archive) Delete(entry domain.Entry) error {
 	return nil
 }
 
+// ListBackupFiles lists the backup files in the backup destination, including
+// those not referenced by the index.
+func (a Archive) ListBackupFiles(fn func(BackupFileInfo) error) error {
+	return a.storageProvider.ListBackupFiles(fn)
+}
+
+// DeleteBackupFileByID deletes the backup file with the given ID, e.g. because
+// it is not referenced by the index.
+func (a Archive) DeleteBackupFileByID(blobID string) error {
+	return a.storageProvider.DeleteBackupFileByID(blobID)
+}
+
+// Forget removes the given entry from the index, without deleting its backup
+// file.
+func (a Archive) Forget(entry domain.Entry) {
+	a.index.deleteEntry(entry.RelPath)
+}
+
+// ReadBackupFileHeader reads the header of the backup file with the given ID,
+// to recover the entry it holds. It returns nil for backup files written by
+// earlier versions, which don't have a header. The content is read too, to
+// verify it and recover the size and digest from the trailer; entries from
+// backup files written before the trailer was introduced have no digest.
+func (a Archive) ReadBackupFileHeader(blobID string) (*domain.Entry, error) {
+	r, err := a.storageProvider.ReadBackupFileByID(blobID)
+	if nil != err {
+		return nil, err
+	}
+	defer r.Close()
+
+	cr, err := a.cryptoContext.Decrypt(throttling.NewReader(r, a.options.DownloadLimiter))
+	if nil != err {
+		return nil, err
+	}
+
+	entry, content, err := readBlobHeader(cr)
+	if nil != err || nil == entry {
+		return nil, err
+	}
+
+	if _, err := io.Copy(io.Discard, content); nil != err {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Recover adds an entry recovered from the header of a backup file to the
+// index.
+func (a Archive) Recover(entry domain.Entry) {
+	a.index.setEntry(entry, EntryFlagsPresentInBackup, true)
+}
+
+// DiscardIndexChanges drops all changes of the index, so that the index in the
+// backup destination remains as it is when the archive is closed.
+func (a Archive) DiscardIndexChanges() {
+	a.index.discard()
+}
+
+// BlobID determines the ID of the backup file for the given entry, which
+// storage providers address it by.
+func BlobID(entry domain.Entry) string {
+	// Entries backed up by earlier versions don't record their blob ID.
+	if "" != entry.BlobID {
+		return entry.BlobID
+	}
+
+	return entry.Hash()
+}
+
+// WalkBackup walks all entries that are present in the backup, except for
+// those in the trash.
+func (a Archive) WalkBackup(fn func(entry domain.Entry)) {
+	a.index.walkIndexSnapshot(func(entry domain.Entry, flags EntryFlags) error {
+		if flags&EntryFlagsPresentInBackup == EntryFlagsPresentInBackup &&
+			0 == entry.TrashTime {
+			fn(entry)
+		}
+
+		return nil
+	})
+}
+
+// WalkTrash walks all entries that are in the trash.
+func (a Archive) WalkTrash(fn func(entry domain.Entry)) {
+	a.index.walkIndexSnapshot(func(entry domain.Entry, flags EntryFlags) error {
+		if 0 != entry.TrashTime {
+			fn(entry)
+		}
+
+		return nil
+	})
+}
+
 // FindLocallyMissing finds entries that are in the backup but not available
-// locally.
+// locally, except for those in the trash and those backed up from a stream,
+// which never have a local file.
 func (a Archive) FindLocallyMissing(fn func(entry domain.Entry)) {
 	a.index.walkIndexSnapshot(func(entry domain.Entry, flags EntryFlags) error {
 		if flags&(EntryFlagsPresentInLocal|EntryFlagsPresentInBackup) ==
-			EntryFlagsPresentInBackup {
+			EntryFlagsPresentInBackup && 0 == entry.TrashTime && !entry.Stream {
 			fn(entry)
 		}
 
@@ -157,7 +437,42 @@ func (a Archive) FindLocallyMissing(fn func(entry domain.Entry)) {
 	})
 }
 
-// Close closes the archive.
+// exit releases the lock of the archive, if any, and exits with the given
+// message.
+func (a Archive) exit(message string) {
+	a.Release()
+	if nil != a.options.Exit {
+		a.options.Exit(message)
+	}
+	glog.Exit(message)
+}
+
+// Close closes the archive, writing the index if it has changed. The lock of
+// the archive is kept until Release, so that the run can still be recorded
+// under it.
 func (a Archive) Close() error {
 	return a.index.Close()
 }
+
+// checkLock fails when the archive was locked, but the lock was lost since, so
+// that the archive is not modified anymore.
+func (a Archive) checkLock() error {
+	if nil == a.lock {
+		return nil
+	}
+	if err := a.lock.Err(); nil != err {
+		return fmt.Errorf("%w: %v", ArchiveLockLost, err)
+	}
+
+	return nil
+}
+
+// Release releases the lock of the archive, if any. It must only be called
+// once the index has been written.
+func (a Archive) Release() {
+	if nil != a.lock {
+		if err := a.lock.Release(); nil != err {
+			glog.Errorf("Failed to release the archive lock: %v", err)
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package archiving
 
 import (
+	"io"
 	"os"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/domain"
+	"github.com/rokeller/bart/throttling"
 )
 
 type backupFile struct {
@@ -41,13 +43,18 @@ func (f backupFile) Close() error {
 	return f.f.Close()
 }
 
-func (f backupFile) Upload() error {
+// Upload uploads the file and returns the number of bytes uploaded.
+func (f backupFile) Upload() (int64, error) {
 	// The file has just been written to. We need to seek to the beginning
 	// before we can upload bytes from it.
-	_, err := f.f.Seek(0, 0)
+	size, err := f.f.Seek(0, io.SeekEnd)
 	if nil != err {
-		return err
+		return 0, err
+	}
+	if _, err := f.f.Seek(0, io.SeekStart); nil != err {
+		return 0, err
 	}
 
-	return f.a.storageProvider.WriteBackupFile(f.e, f.f)
+	r := throttling.NewReadSeeker(f.f, f.a.options.UploadLimiter)
+	return size, f.a.storageProvider.WriteBackupFile(f.e, r)
 }
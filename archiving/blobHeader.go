@@ -0,0 +1,194 @@
+package archiving
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/rokeller/bart/domain"
+	"google.golang.org/protobuf/proto"
+)
+
+// blobHeaderMagic marks the beginning of the header of a backup file. Backup
+// files written by earlier versions don't have a header.
+var blobHeaderMagic = []byte("BARTBLOB")
+
+// blobTrailerMagic marks the beginning of the trailer of a backup file, which
+// follows the content with its size and digest. They are not known yet when
+// the header is written.
+var blobTrailerMagic = []byte("BARTTAIL")
+
+// blobTrailerSize is the size of the trailer: the magic, the size of the
+// content and its digest.
+const blobTrailerSize = 8 + 8 + sha256.Size
+
+// maxBlobHeaderSize limits the size of headers to read, so that garbage
+// following the magic by chance doesn't cause huge allocations.
+const maxBlobHeaderSize = 64 * 1024
+
+// writeBlobHeader writes the header for the given entry. The header is written
+// to the encrypted stream, so the relative path is not revealed.
+func writeBlobHeader(w io.Writer, entry domain.Entry) error {
+	header := &domain.BlobHeader{
+		RelPath:      proto.String(entry.RelPath),
+		LastModified: proto.Int64(entry.Timestamp),
+		Size:         proto.Int64(entry.Size),
+		BackupTime:   proto.Int64(entry.BackupTime),
+		Trailer:      proto.Bool(true),
+	}
+	if entry.Stream {
+		header.Stream = proto.Bool(true)
+	}
+
+	data, err := proto.Marshal(header)
+	if nil != err {
+		return err
+	}
+
+	headerSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(headerSize, uint32(len(data)))
+
+	for _, b := range [][]byte{blobHeaderMagic, headerSize, data} {
+		if _, err := w.Write(b); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBlobTrailer writes the trailer with the size and digest of the content.
+func writeBlobTrailer(w io.Writer, size int64, digest []byte) error {
+	trailer := make([]byte, 0, blobTrailerSize)
+	trailer = append(trailer, blobTrailerMagic...)
+	trailer = binary.LittleEndian.AppendUint64(trailer, uint64(size))
+	trailer = append(trailer, digest...)
+
+	_, err := w.Write(trailer)
+	return err
+}
+
+// readBlobHeader reads the header of a (decrypted) backup file. It returns the
+// entry described by the header, or nil if the backup file has no header, and
+// a reader for the content of the backup file. When the backup file has a
+// trailer, the reader verifies the content against it, and the entry gets the
+// size and digest from it once all of the content was read.
+func readBlobHeader(r io.Reader) (*domain.Entry, io.Reader, error) {
+	magic := make([]byte, len(blobHeaderMagic))
+	n, err := io.ReadFull(r, magic)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// Backup files from earlier versions can be shorter than the magic.
+		return nil, bytes.NewReader(magic[:n]), nil
+	} else if nil != err {
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(magic, blobHeaderMagic) {
+		return nil, io.MultiReader(bytes.NewReader(magic), r), nil
+	}
+
+	headerSize := make([]byte, 4)
+	if _, err := io.ReadFull(r, headerSize); nil != err {
+		return nil, nil, err
+	}
+
+	dataSize := binary.LittleEndian.Uint32(headerSize)
+	if dataSize > maxBlobHeaderSize {
+		return nil, nil, BlobHeaderInvalid
+	}
+
+	data := make([]byte, dataSize)
+	if _, err := io.ReadFull(r, data); nil != err {
+		return nil, nil, err
+	}
+
+	header := &domain.BlobHeader{}
+	if err := proto.Unmarshal(data, header); nil != err {
+		return nil, nil, BlobHeaderInvalid
+	}
+
+	entry := &domain.Entry{
+		RelPath: header.GetRelPath(),
+		EntryMetadata: domain.EntryMetadata{
+			Timestamp:  header.GetLastModified(),
+			Size:       header.GetSize(),
+			BackupTime: header.GetBackupTime(),
+			Stream:     header.GetStream(),
+		},
+	}
+
+	// Backup files written before the trailer was introduced end with the
+	// content.
+	if !header.GetTrailer() {
+		return entry, r, nil
+	}
+
+	return entry, &trailerReader{
+		r:      r,
+		entry:  entry,
+		chunk:  make([]byte, 32*1024),
+		digest: sha256.New(),
+	}, nil
+}
+
+// trailerReader reads the content of a backup file, holding back the trailer
+// that follows it. At the end of the content, it verifies the content against
+// the trailer and sets the size and digest of the entry.
+type trailerReader struct {
+	r     io.Reader
+	entry *domain.Entry
+	chunk []byte
+	// pending holds the bytes read, but not returned yet, which may be the
+	// trailer.
+	pending []byte
+	digest  hash.Hash
+	size    int64
+	err     error
+	done    bool
+}
+
+func (t *trailerReader) Read(p []byte) (int, error) {
+	for len(t.pending) <= blobTrailerSize && nil == t.err {
+		n, err := t.r.Read(t.chunk)
+		t.pending = append(t.pending, t.chunk[:n]...)
+		t.err = err
+	}
+
+	if len(t.pending) > blobTrailerSize {
+		n := copy(p, t.pending[:len(t.pending)-blobTrailerSize])
+		t.digest.Write(p[:n])
+		t.size += int64(n)
+		t.pending = t.pending[n:]
+
+		return n, nil
+	}
+
+	if !t.done && errors.Is(t.err, io.EOF) {
+		t.done = true
+		t.err = t.verify()
+	}
+
+	return 0, t.err
+}
+
+// verify verifies the content read against the trailer.
+func (t *trailerReader) verify() error {
+	if len(t.pending) != blobTrailerSize ||
+		!bytes.Equal(t.pending[:len(blobTrailerMagic)], blobTrailerMagic) {
+		return BlobTrailerInvalid
+	}
+
+	size := int64(binary.LittleEndian.Uint64(t.pending[len(blobTrailerMagic):]))
+	digest := t.pending[len(blobTrailerMagic)+8:]
+	if size != t.size || !bytes.Equal(digest, t.digest.Sum(nil)) {
+		return DigestMismatch
+	}
+
+	t.entry.Size = size
+	t.entry.Digest = bytes.Clone(digest)
+
+	return io.EOF
+}
@@ -0,0 +1,162 @@
+package archiving
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/rokeller/bart/domain"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestBlob creates the (decrypted) backup file for the entry and content.
+func newTestBlob(t *testing.T, entry domain.Entry, content string) []byte {
+	t.Helper()
+
+	digest := sha256.Sum256([]byte(content))
+	buf := &bytes.Buffer{}
+	if err := writeBlobHeader(buf, entry); nil != err {
+		t.Fatalf("writing the header failed: %v", err)
+	}
+	buf.WriteString(content)
+	if err := writeBlobTrailer(buf, int64(len(content)), digest[:]); nil != err {
+		t.Fatalf("writing the trailer failed: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// readTestBlob reads the header and content of the backup file.
+func readTestBlob(blob []byte) (*domain.Entry, string, error) {
+	entry, r, err := readBlobHeader(bytes.NewReader(blob))
+	if nil != err {
+		return nil, "", err
+	}
+
+	// Read one byte at a time, so the trailer is held back across many reads.
+	content, err := io.ReadAll(iotest.OneByteReader(r))
+	return entry, string(content), err
+}
+
+func TestBlobHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   domain.Entry
+		content string
+	}{
+		{"file", newTestEntry("dir/file.txt"), "some content"},
+		{"empty file", newTestEntry("empty"), ""},
+		{"large file", newTestEntry("large"), string(bytes.Repeat([]byte("0123456789"), 10_000))},
+		{"stream", domain.Entry{
+			RelPath:       "db/dump.sql",
+			EntryMetadata: domain.EntryMetadata{Timestamp: 1700000000, Stream: true},
+		}, "stream"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.entry.BackupTime = 1700000100
+			blob := newTestBlob(t, test.entry, test.content)
+
+			entry, content, err := readTestBlob(blob)
+			if nil != err {
+				t.Fatalf("reading the backup file failed: %v", err)
+			}
+			if test.content != content {
+				t.Errorf("got %d bytes of content, want %d", len(content), len(test.content))
+			}
+
+			digest := sha256.Sum256([]byte(test.content))
+			if nil == entry || test.entry.RelPath != entry.RelPath ||
+				test.entry.Timestamp != entry.Timestamp ||
+				test.entry.BackupTime != entry.BackupTime ||
+				test.entry.Stream != entry.Stream ||
+				int64(len(test.content)) != entry.Size ||
+				!bytes.Equal(digest[:], entry.Digest) {
+				t.Errorf("got entry %+v, want %+v with size %d and the digest", entry, test.entry, len(test.content))
+			}
+		})
+	}
+}
+
+func TestBlobHeaderLegacy(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"shorter than the magic", "BART"},
+		{"longer than the magic", "this backup file was written without a header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry, content, err := readTestBlob([]byte(test.content))
+			if nil != err {
+				t.Fatalf("reading the backup file failed: %v", err)
+			}
+			if nil != entry {
+				t.Errorf("got entry %+v for a backup file without a header", entry)
+			}
+			if test.content != content {
+				t.Errorf("got content '%s', want '%s'", content, test.content)
+			}
+		})
+	}
+}
+
+func TestBlobHeaderWithoutTrailer(t *testing.T) {
+	// Backup files written before the trailer was introduced end with the
+	// content, and their entries have no digest.
+	data, err := proto.Marshal(&domain.BlobHeader{
+		RelPath:      proto.String("file"),
+		LastModified: proto.Int64(1700000000),
+	})
+	if nil != err {
+		t.Fatalf("marshalling the header failed: %v", err)
+	}
+	blob := append([]byte{}, blobHeaderMagic...)
+	blob = binary.LittleEndian.AppendUint32(blob, uint32(len(data)))
+	blob = append(blob, data...)
+	blob = append(blob, "content"...)
+
+	entry, content, err := readTestBlob(blob)
+	if nil != err {
+		t.Fatalf("reading the backup file failed: %v", err)
+	}
+	if "content" != content || nil == entry || "file" != entry.RelPath || nil != entry.Digest {
+		t.Errorf("got entry %+v with content '%s'", entry, content)
+	}
+}
+
+func TestBlobHeaderInvalid(t *testing.T) {
+	blob := append([]byte{}, blobHeaderMagic...)
+	blob = append(blob, 0xff, 0xff, 0xff, 0xff)
+
+	if _, _, err := readTestBlob(blob); !errors.Is(err, BlobHeaderInvalid) {
+		t.Errorf("got error %v, want %v", err, BlobHeaderInvalid)
+	}
+}
+
+func TestBlobTrailerVerified(t *testing.T) {
+	blob := newTestBlob(t, newTestEntry("file"), "some content")
+	headerSize := len(blob) - len("some content") - blobTrailerSize
+
+	corrupt := bytes.Clone(blob)
+	corrupt[headerSize] ^= 0xff
+	if _, _, err := readTestBlob(corrupt); !errors.Is(err, DigestMismatch) {
+		t.Errorf("corrupt content: got error %v, want %v", err, DigestMismatch)
+	}
+
+	if _, _, err := readTestBlob(blob[:len(blob)-1]); !errors.Is(err, BlobTrailerInvalid) {
+		t.Errorf("truncated trailer: got error %v, want %v", err, BlobTrailerInvalid)
+	}
+
+	if _, _, err := readTestBlob(blob[:headerSize+2]); !errors.Is(err, BlobTrailerInvalid) {
+		t.Errorf("truncated content: got error %v, want %v", err, BlobTrailerInvalid)
+	}
+}
@@ -0,0 +1,214 @@
+package archiving
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/domain"
+	"google.golang.org/protobuf/proto"
+)
+
+// RunRecord describes a single run of a command against the archive.
+type RunRecord struct {
+	ID              string
+	Command         string
+	Start           time.Time
+	End             time.Time
+	Host            string
+	Status          string
+	WhatIf          bool
+	DiscoveredFiles int64
+	DoneFiles       int64
+	DoneBytes       int64
+	FailedFiles     int64
+	FailedBytes     int64
+	Errors          []string
+	// Tags are set by the user to tell runs apart, e.g. for retention.
+	Tags []string
+}
+
+// NewRunRecordID creates a new ID for a run record started at the given time.
+// IDs sort in chronological order.
+func NewRunRecordID(start time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); nil != err {
+		glog.Exitf("Failed to generate random run record ID: %v", err)
+	}
+
+	return start.UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// runRecordIDPattern matches the IDs created by NewRunRecordID.
+var runRecordIDPattern = regexp.MustCompile(`^[0-9]{8}T[0-9]{6}\.[0-9]{3}Z-[0-9a-f]{8}$`)
+
+// ValidRunRecordID determines if the given ID is one created by
+// NewRunRecordID. Other IDs, e.g. '../settings', must not reach the storage
+// provider.
+func ValidRunRecordID(id string) bool {
+	return runRecordIDPattern.MatchString(id)
+}
+
+func checkRunRecordID(id string) error {
+	if !ValidRunRecordID(id) {
+		return fmt.Errorf("%w: '%s'", RunRecordIDInvalid, id)
+	}
+
+	return nil
+}
+
+// AppendRunRecord stores the given run record in the archive.
+func (a Archive) AppendRunRecord(record RunRecord) error {
+	if err := checkRunRecordID(record.ID); nil != err {
+		return err
+	}
+
+	w, err := a.storageProvider.NewRunRecordWriter(record.ID)
+	if nil != err {
+		return err
+	}
+
+	cw, err := a.cryptoContext.Encrypt(w)
+	if nil != err {
+		Abort(w)
+		return err
+	}
+
+	if err := writeRunRecord(record, cw); nil != err {
+		// Don't store an incomplete run record.
+		Abort(w)
+		return err
+	}
+
+	// Closing the crypto writer also closes the run record writer.
+	return cw.Close()
+}
+
+// GetRunRecord reads the run record with the given ID from the archive.
+func (a Archive) GetRunRecord(id string) (RunRecord, error) {
+	if err := checkRunRecordID(id); nil != err {
+		return RunRecord{}, err
+	}
+
+	r, err := a.storageProvider.ReadRunRecord(id)
+	if nil != err {
+		return RunRecord{}, err
+	}
+	defer r.Close()
+
+	cr, err := a.cryptoContext.Decrypt(r)
+	if nil != err {
+		return RunRecord{}, err
+	}
+
+	return readRunRecord(cr)
+}
+
+// ListRunRecords reads all run records from the archive, in chronological
+// order.
+func (a Archive) ListRunRecords() ([]RunRecord, error) {
+	ids, err := a.storageProvider.ListRunRecords()
+	if nil != err {
+		return nil, err
+	}
+	sort.Strings(ids)
+
+	records := make([]RunRecord, 0, len(ids))
+	for _, id := range ids {
+		if !ValidRunRecordID(id) {
+			glog.Warningf("Ignoring the unexpected run record '%s'.", id)
+			continue
+		}
+
+		record, err := a.GetRunRecord(id)
+		if nil != err {
+			glog.Errorf("Failed to read run record '%s': %v", id, err)
+			continue
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// DeleteRunRecord deletes the run record with the given ID from the archive.
+func (a Archive) DeleteRunRecord(id string) error {
+	if err := checkRunRecordID(id); nil != err {
+		return err
+	}
+
+	return a.storageProvider.DeleteRunRecord(id)
+}
+
+func writeRunRecord(record RunRecord, w io.Writer) error {
+	data, err := proto.Marshal(&domain.RunRecord{
+		Id:              proto.String(record.ID),
+		Command:         proto.String(record.Command),
+		Start:           proto.Int64(record.Start.UnixMilli()),
+		End:             proto.Int64(record.End.UnixMilli()),
+		Host:            proto.String(record.Host),
+		Status:          proto.String(record.Status),
+		WhatIf:          proto.Bool(record.WhatIf),
+		DiscoveredFiles: proto.Int64(record.DiscoveredFiles),
+		DoneFiles:       proto.Int64(record.DoneFiles),
+		DoneBytes:       proto.Int64(record.DoneBytes),
+		FailedFiles:     proto.Int64(record.FailedFiles),
+		FailedBytes:     proto.Int64(record.FailedBytes),
+		Errors:          record.Errors,
+		Tags:            record.Tags,
+	})
+	if nil != err {
+		return err
+	}
+
+	recordSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(recordSize, uint32(len(data)))
+
+	if _, err := w.Write(recordSize); nil != err {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+func readRunRecord(r io.Reader) (RunRecord, error) {
+	recordSize := make([]byte, 4)
+	if _, err := io.ReadFull(r, recordSize); nil != err {
+		return RunRecord{}, err
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(recordSize))
+	if _, err := io.ReadFull(r, data); nil != err {
+		return RunRecord{}, err
+	}
+
+	record := &domain.RunRecord{}
+	if err := proto.Unmarshal(data, record); nil != err {
+		return RunRecord{}, err
+	}
+
+	return RunRecord{
+		ID:              record.GetId(),
+		Command:         record.GetCommand(),
+		Start:           time.UnixMilli(record.GetStart()),
+		End:             time.UnixMilli(record.GetEnd()),
+		Host:            record.GetHost(),
+		Status:          record.GetStatus(),
+		WhatIf:          record.GetWhatIf(),
+		DiscoveredFiles: record.GetDiscoveredFiles(),
+		DoneFiles:       record.GetDoneFiles(),
+		DoneBytes:       record.GetDoneBytes(),
+		FailedFiles:     record.GetFailedFiles(),
+		FailedBytes:     record.GetFailedBytes(),
+		Errors:          record.GetErrors(),
+		Tags:            record.GetTags(),
+	}, nil
+}
@@ -0,0 +1,54 @@
+package archiving
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestValidRunRecordID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{NewRunRecordID(time.Now()), true},
+		{"20260315T120000.000Z-0123abcd", true},
+		{"", false},
+		{"../settings", false},
+		{"../.settings", false},
+		{"20260315T120000.000Z-0123abcd/../../.settings", false},
+		{"20260315T120000.000Z-0123ABCD", false},
+		{"20260315T120000.000Z-0123abc", false},
+		{"20260315T120000Z-0123abcd", false},
+		{" 20260315T120000.000Z-0123abcd", false},
+		{"20260315T120000.000Z-0123abcd\n", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.id, func(t *testing.T) {
+			if got := ValidRunRecordID(test.id); got != test.want {
+				t.Errorf("ValidRunRecordID('%s') = %v, want %v", test.id, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunRecordIDInvalid(t *testing.T) {
+	a := newTestArchive(t, newMemoryProvider())
+
+	// Invalid IDs don't reach the storage provider, which would report the run
+	// record as not found.
+	if _, err := a.GetRunRecord("../settings"); !errors.Is(err, RunRecordIDInvalid) {
+		t.Errorf("GetRunRecord got error %v, want %v", err, RunRecordIDInvalid)
+	}
+	if err := a.DeleteRunRecord("../settings"); !errors.Is(err, RunRecordIDInvalid) {
+		t.Errorf("DeleteRunRecord got error %v, want %v", err, RunRecordIDInvalid)
+	}
+	if err := a.AppendRunRecord(RunRecord{ID: "../settings"}); !errors.Is(err, RunRecordIDInvalid) {
+		t.Errorf("AppendRunRecord got error %v, want %v", err, RunRecordIDInvalid)
+	}
+
+	if _, err := a.GetRunRecord(NewRunRecordID(time.Now())); !errors.Is(err, RunRecordNotFound) {
+		t.Errorf("GetRunRecord got error %v, want %v", err, RunRecordNotFound)
+	}
+}
@@ -1,7 +1,10 @@
 package archiving
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/domain"
@@ -23,57 +26,86 @@ const (
 type Index struct {
 	archive *Archive
 
-	// entries tracks entries in the index; must only accessed directly by
-	// handleMessages, handleMessage or during initialization.
-	entries map[string]indexEntry
-
-	messages chan message
-	dirty    bool
-	closed   bool
-
-	wgClose *sync.WaitGroup
+	// shards holds the shards of the index, one for every possible shard
+	// name. The map itself is never modified after initialization, so it can
+	// be read concurrently; the shards guard their entries themselves.
+	shards map[string]*indexShard
+	// rewrite is set when all shards need to be written, replacing what is in
+	// the backup destination: when the index was read from the monolithic
+	// index of earlier versions, or when the index is rebuilt.
+	rewrite bool
+	// cache holds local copies of the index shards.
+	cache indexCache
+
+	dirty  *atomic.Bool
+	closed *atomic.Bool
+	// writeMutex makes sure the index is only written by one goroutine at a
+	// time, i.e. by the maintenance ticker or when closing the index.
+	writeMutex *sync.Mutex
+
+	// policy defines when checkpoints are uploaded. changedEntries and
+	// backedUpBytes track the changes since the last checkpoint, to decide
+	// when the next checkpoint is due.
+	policy            CheckpointPolicy
+	changedEntries    *atomic.Int64
+	backedUpBytes     *atomic.Int64
+	checkpointPending chan bool
+
+	stopMaintenance chan bool
+	wgClose         *sync.WaitGroup
 }
 
 func newIndex(a *Archive) *Index {
 	index := Index{
-		archive:  a,
-		entries:  make(map[string]indexEntry),
-		messages: make(chan message, 10),
-		dirty:    false,
-		closed:   false,
+		archive: a,
+		shards:  make(map[string]*indexShard, indexShardCount),
+		cache:   newIndexCache(a.options.IndexCacheDir, a.settings),
+		dirty:   &atomic.Bool{},
+		closed:  &atomic.Bool{},
+
+		writeMutex:        &sync.Mutex{},
+		policy:            a.options.Checkpoints,
+		changedEntries:    &atomic.Int64{},
+		backedUpBytes:     &atomic.Int64{},
+		checkpointPending: make(chan bool, 1),
+		stopMaintenance:   make(chan bool),
+		wgClose:           &sync.WaitGroup{},
+	}
 
-		wgClose: &sync.WaitGroup{},
+	for n := 0; n < indexShardCount; n++ {
+		name := fmt.Sprintf("%02x", n)
+		index.shards[name] = newIndexShard(name)
 	}
 
 	index.load()
 	index.wgClose.Add(1)
-	go index.handleMessages()
+	go index.maintain()
 
 	return &index
 }
 
 func (i *Index) Count() int {
-	var count int
-	i.sync(func() {
-		count = len(i.entries)
-	})
+	count := 0
+	for _, shard := range i.shards {
+		shard.mutex.RLock()
+		count += len(shard.entries)
+		shard.mutex.RUnlock()
+	}
 
 	return count
 }
 
 func (i *Index) Dirty() bool {
-	return i.dirty
+	return i.dirty.Load()
 }
 
 func (i *Index) Close() error {
-	close(i.messages)
+	close(i.stopMaintenance)
 	i.wgClose.Wait()
-	i.closed = true
+	i.closed.Store(true)
 
 	if i.Dirty() {
 		glog.Info("The archive index has changed and needs to be uploaded.")
-		// Calling writeIndex here is safe because message handler must have
-		// been stopped at the beginning of the method.
 		if err := i.writeIndex(); nil != err {
 			glog.Errorf("The archive index could not be uploaded: %v", err)
 			return err
@@ -85,83 +117,214 @@ func (i *Index) Close() error {
 	return nil
 }
 
+// discard drops all changes of the index, so they are not written.
+func (i *Index) discard() {
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+
+	for _, shard := range i.shards {
+		shard.takeChanges()
+	}
+	i.rewrite = false
+	i.dirty.Store(false)
+}
+
+// maintain uploads checkpoints of the index while it changes, according to the
+// checkpoint policy.
+func (i *Index) maintain() {
+	defer i.wgClose.Done()
+
+	// A nil channel never delivers, so without an interval only the other
+	// limits trigger checkpoints.
+	var tick <-chan time.Time
+	if i.policy.Interval > 0 {
+		maintenanceTicker := time.NewTicker(i.policy.Interval)
+		defer maintenanceTicker.Stop()
+		tick = maintenanceTicker.C
+	}
+
+	for {
+		select {
+		case <-i.stopMaintenance:
+			glog.V(1).Info("Index maintenance terminated.")
+			return
+
+		case <-tick:
+			glog.V(1).Info("Checkpoint interval elapsed. Check for changes in index.")
+			i.checkpoint()
+
+		case <-i.checkpointPending:
+			glog.V(1).Info("Checkpoint limit reached.")
+			i.checkpoint()
+		}
+	}
+}
+
+// checkpoint uploads a checkpoint of the index if it has changed.
+func (i *Index) checkpoint() {
+	if !i.Dirty() {
+		return
+	}
+
+	i.changedEntries.Store(0)
+	i.backedUpBytes.Store(0)
+
+	glog.Info("The index has changed, upload current index checkpoint to backup destination.")
+	if err := i.writeIndex(); nil != err {
+		glog.Errorf("The archive index could not be uploaded: %v", err)
+	}
+}
+
+// trackChangedEntry tracks a changed entry for the checkpoint policy.
+func (i *Index) trackChangedEntry() {
+	n := i.changedEntries.Add(1)
+	if i.policy.Entries > 0 && n >= i.policy.Entries {
+		i.requestCheckpoint()
+	}
+}
+
+// trackBackedUpBytes tracks backed up bytes for the checkpoint policy.
+func (i *Index) trackBackedUpBytes(bytes int64) {
+	n := i.backedUpBytes.Add(bytes)
+	if i.policy.Bytes > 0 && n >= i.policy.Bytes {
+		i.requestCheckpoint()
+	}
+}
+
+func (i *Index) requestCheckpoint() {
+	select {
+	case i.checkpointPending <- true:
+	default:
+		// A checkpoint is pending already.
+	}
+}
+
 func (i *Index) load() {
+	if i.archive.options.RebuildIndex {
+		if err := i.readShardGenerations(); nil != err {
+			i.archive.exit(fmt.Sprintf("Failed to list archive index shards: %v", err))
+		}
+		return
+	}
+
 	if err := i.readIndex(); nil == err {
 		return
 	} else if err == IndexNotFound {
 		// It's not an error if the index does not exist yet.
 		return
 	} else if err == IndexDecryptionFailed {
-		glog.Exit("Index decryption failed. Did you provide the correct password?")
+		// With a key check, the password is known to be right.
+		if nil != i.archive.settings.KeyCheck() {
+			i.archive.exit("The archive index is corrupt. Use 'index rebuild' to rebuild it.")
+		}
+		i.archive.exit("Index decryption failed. Did you provide the correct password?")
 	} else {
-		glog.Exit("Failed to load archive index: %v", err)
+		i.archive.exit(fmt.Sprintf("Failed to load archive index: %v", err))
 	}
 }
 
-// walkIndex walks through the index. It is the caller's responsibility to make
-// sure there is mutually exclusive access to the index, e.g. through the use
-// of Index.sync, or by calling before index message handling has started or
-// after it has finished.
-func (i *Index) walkIndex(fn func(domain.Entry, EntryFlags) error) error {
-	var err error
-	err = nil
-
-	for key, value := range i.entries {
-		entry := domain.Entry{
-			RelPath:       key,
-			EntryMetadata: value.EntryMetadata,
-		}
-
-		if err = fn(entry, value.EntryFlags); nil != err {
-			break
+// walkIndexSnapshot walks a snapshot of the current index, applying the given
+// fn for every entry. The snapshot is taken one shard at a time, so the index
+// can be modified concurrently, including by fn.
+func (i *Index) walkIndexSnapshot(fn func(domain.Entry, EntryFlags) error) error {
+	for _, shard := range i.shards {
+		for key, value := range shard.snapshot() {
+			entry := domain.Entry{
+				RelPath:       key,
+				EntryMetadata: value.EntryMetadata,
+			}
+
+			if err := fn(entry, value.EntryFlags); nil != err {
+				return err
+			}
 		}
 	}
 
-	return err
+	return nil
 }
 
-// walkIndexSnapshot creates a snapshot of the current index and then walks the
-// entries of that snapshot, applying the given fn for every entry.
-func (i *Index) walkIndexSnapshot(fn func(domain.Entry, EntryFlags) error) error {
-	// Track a snapshot of the current index' keys.
-	snapshot := make(map[string]indexEntry)
-	extractKeys := func() {
-		for key, value := range i.entries {
-			snapshot[key] = value
-		}
+func (i *Index) needsBackup(entry domain.Entry) bool {
+	shard := i.shardFor(entry.RelPath)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	existing, found := shard.entries[entry.RelPath]
+
+	// The size is unknown for entries backed up by earlier versions, which
+	// don't have a backup time either. Files in the trash are backed up again
+	// when they reappear.
+	backupNeeded := !found ||
+		(existing.EntryFlags&EntryFlagsPresentInBackup) == EntryFlagsNone ||
+		0 != existing.TrashTime ||
+		existing.Timestamp < entry.Timestamp ||
+		(0 != existing.BackupTime && existing.Size != entry.Size)
+
+	// Let's mark the file as present in local, keeping the metadata of the
+	// backed up file.
+	if found {
+		existing.EntryFlags |= EntryFlagsPresentInLocal
+		shard.entries[entry.RelPath] = existing
 	}
-	i.sync(extractKeys)
 
-	// Now iterate through the snapshot applying the fn to every item.
-	var err error
-	err = nil
+	return backupNeeded
+}
 
-	for key, value := range snapshot {
-		entry := domain.Entry{
-			RelPath:       key,
-			EntryMetadata: value.EntryMetadata,
-		}
+func (i *Index) getEntry(relPath string) *indexEntry {
+	shard := i.shardFor(relPath)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
 
-		if err = fn(entry, value.EntryFlags); nil != err {
-			break
-		}
+	indexEntry, found := shard.entries[relPath]
+	if !found {
+		return nil
 	}
 
-	return err
+	return &indexEntry
 }
 
-func (i *Index) needsBackup(entry domain.Entry) bool {
-	indexEntry := i.getEntry(entry.RelPath)
-	found := nil != indexEntry
+func (i *Index) setEntry(entry domain.Entry, flags EntryFlags, markDirty bool) {
+	if i.closed.Load() {
+		glog.Warningf("Not setting entry for '%s', because the index is closed.", entry.RelPath)
+		return
+	}
 
-	backupNeeded := !found ||
-		(indexEntry.EntryFlags&EntryFlagsPresentInBackup) == EntryFlagsNone ||
-		indexEntry.Timestamp < entry.Timestamp
+	value := indexEntry{
+		EntryMetadata: entry.EntryMetadata,
+		EntryFlags:    flags,
+	}
+
+	shard := i.shardFor(entry.RelPath)
+	shard.mutex.Lock()
+	if markDirty {
+		shard.changes[entry.RelPath] = indexChange{indexEntry: value}
+		i.dirty.Store(true)
+	}
+	shard.entries[entry.RelPath] = value
+	shard.mutex.Unlock()
 
-	// Let's mark the file as present in local
+	if markDirty {
+		i.trackChangedEntry()
+	}
+}
+
+func (i *Index) deleteEntry(relPath string) {
+	if i.closed.Load() {
+		glog.Warningf("Not deleting entry for '%s', because the index is closed.", relPath)
+		return
+	}
+
+	shard := i.shardFor(relPath)
+	shard.mutex.Lock()
+	value, found := shard.entries[relPath]
+	delete(shard.entries, relPath)
 	if found {
-		i.setEntry(entry, indexEntry.EntryFlags|EntryFlagsPresentInLocal, false)
+		// We removed an existing entry from the index, so mark it dirty.
+		shard.changes[relPath] = indexChange{indexEntry: value, deleted: true}
+		i.dirty.Store(true)
 	}
+	shard.mutex.Unlock()
 
-	return backupNeeded
+	if found {
+		i.trackChangedEntry()
+	}
 }
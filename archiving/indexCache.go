@@ -0,0 +1,151 @@
+package archiving
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/settings"
+)
+
+// indexCache keeps copies of the index shards on the local disk, so they don't
+// need to be downloaded again while they haven't changed in the backup
+// destination. The copies are kept exactly as in the backup destination, i.e.
+// encrypted.
+type indexCache struct {
+	// dir is the directory holding the cached shards of the archive; caching
+	// is disabled when empty.
+	dir string
+}
+
+// indexCacheWriter writes a shard to the cache. The shard is only added to the
+// cache when it is committed.
+type indexCacheWriter struct {
+	c     indexCache
+	shard string
+	f     *os.File
+}
+
+// newIndexCache creates the cache for the archive with the given settings under
+// the given base directory. The cache is disabled when baseDir is empty.
+func newIndexCache(baseDir string, s settings.Settings) indexCache {
+	if "" == baseDir {
+		return indexCache{}
+	}
+
+	// The salt is unique for each archive, so it identifies the archive
+	// without revealing where it is stored.
+	id := sha256.Sum256(s.Salt())
+	dir := filepath.Join(baseDir, hex.EncodeToString(id[:16]))
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		glog.Warningf("Failed to create index cache directory, not using the cache: %v", err)
+		return indexCache{}
+	}
+
+	return indexCache{dir: dir}
+}
+
+// open opens the cached copy of the given version of the shard, if available.
+func (c indexCache) open(shard string, version Version) (io.ReadCloser, bool) {
+	if "" == c.dir || "" == version {
+		return nil, false
+	}
+
+	f, err := os.Open(c.path(shard, version))
+	if nil != err {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Failed to open cached index shard '%s': %v", shard, err)
+		}
+		return nil, false
+	}
+
+	return f, true
+}
+
+// newWriter creates a writer for a new copy of the given shard, or nil when
+// caching is disabled.
+func (c indexCache) newWriter(shard string) *indexCacheWriter {
+	if "" == c.dir {
+		return nil
+	}
+
+	f, err := os.CreateTemp(c.dir, shard+".tmp-*")
+	if nil != err {
+		glog.Warningf("Failed to create cached index shard '%s': %v", shard, err)
+		return nil
+	}
+
+	return &indexCacheWriter{c: c, shard: shard, f: f}
+}
+
+func (c indexCache) path(shard string, version Version) string {
+	// Versions may contain characters that are not allowed in file names.
+	hash := sha256.Sum256([]byte(version))
+	return filepath.Join(c.dir, shard+"-"+hex.EncodeToString(hash[:8]))
+}
+
+// Write implements io.Writer. Failures are only logged, since the cache is
+// optional.
+func (w *indexCacheWriter) Write(p []byte) (int, error) {
+	if nil != w.f {
+		if _, err := w.f.Write(p); nil != err {
+			glog.Warningf("Failed to write cached index shard '%s': %v", w.shard, err)
+			w.Discard()
+		}
+	}
+
+	return len(p), nil
+}
+
+// Commit adds the written data to the cache as the given version of the shard,
+// replacing other versions of the shard.
+func (w *indexCacheWriter) Commit(version Version) {
+	if nil == w.f {
+		return
+	}
+
+	tempPath := w.f.Name()
+	err := w.f.Close()
+	w.f = nil
+	if nil == err {
+		err = os.Rename(tempPath, w.c.path(w.shard, version))
+	}
+	if nil != err {
+		glog.Warningf("Failed to store cached index shard '%s': %v", w.shard, err)
+		os.Remove(tempPath)
+		return
+	}
+
+	w.c.removeStale(w.shard, filepath.Base(w.c.path(w.shard, version)))
+}
+
+// Discard drops the written data.
+func (w *indexCacheWriter) Discard() {
+	if nil == w.f {
+		return
+	}
+
+	w.f.Close()
+	os.Remove(w.f.Name())
+	w.f = nil
+}
+
+// removeStale removes all cached versions of the shard except for the one to
+// keep.
+func (c indexCache) removeStale(shard, keep string) {
+	entries, err := os.ReadDir(c.dir)
+	if nil != err {
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != keep && strings.HasPrefix(name, shard+"-") {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+	}
+}
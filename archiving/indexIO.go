@@ -3,92 +3,485 @@ package archiving
 import (
 	"compress/gzip"
 	"encoding/binary"
+	"errors"
 	"io"
+	"sort"
+	"sync"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/domain"
 	"google.golang.org/protobuf/proto"
 )
 
+// maxIndexWriteAttempts limits how often writing an index shard is attempted
+// when it keeps being changed concurrently.
+const maxIndexWriteAttempts = 5
+
+// indexReadConcurrency limits how many index shards are read concurrently.
+const indexReadConcurrency = 8
+
 func (i *Index) readIndex() error {
-	r, err := i.archive.storageProvider.ReadIndex()
+	versions, err := i.archive.storageProvider.ListIndexShards()
+	if nil != err {
+		glog.Errorf("error listing index shards from provider: %v", err)
+		return err
+	}
+
+	_, hasLegacy := versions[LegacyIndexShard]
+	delete(versions, LegacyIndexShard)
+
+	if len(versions) == 0 && !hasLegacy {
+		return IndexNotFound
+	}
+
+	// The legacy index is only deleted once all shards have been written, so
+	// when splitting it into shards was interrupted, it still holds the entries
+	// of the shards that were not written yet. The shards that were written
+	// replace its entries below.
+	if hasLegacy {
+		if err := i.readLegacyIndex(); nil != err {
+			return err
+		}
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+
+	// This happens during initialization, so there is no need for locking.
+	i.readGenerations(versions)
+
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	semaphore := make(chan bool, indexReadConcurrency)
+	var firstErr error
+
+	for _, shard := range i.shards {
+		if len(shard.generations) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		semaphore <- true
+		go func(shard *indexShard) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			entries, err := i.readNewestGeneration(shard, versions)
+			if nil != err {
+				mutex.Lock()
+				if nil == firstErr {
+					firstErr = err
+				}
+				mutex.Unlock()
+				return
+			}
+
+			shard.mutex.Lock()
+			shard.entries = entries
+			shard.mutex.Unlock()
+		}(shard)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// readGenerations records the generations of the shards from the given names
+// of the index shards in the backup destination.
+func (i *Index) readGenerations(versions map[string]Version) {
+	for name := range versions {
+		shardName, generation, ok := parseGenerationName(name)
+		shard, found := i.shards[shardName]
+		if !ok || !found {
+			glog.Warningf("Ignoring unexpected index shard '%s'.", name)
+			continue
+		}
+
+		shard.generations = append(shard.generations, generation)
+	}
+
+	for _, shard := range i.shards {
+		sort.Ints(shard.generations)
+	}
+}
+
+// readNewestGeneration reads the entries of the newest generation of the shard
+// that can be read. When the newest generation is corrupt, the entries of the
+// previous generations are read instead.
+func (i *Index) readNewestGeneration(shard *indexShard, versions map[string]Version) (map[string]indexEntry, error) {
+	var firstErr error
+
+	for n := len(shard.generations) - 1; n >= 0; n-- {
+		generation := shard.generations[n]
+		name := generationName(shard.name, generation)
+		entries, err := i.readShard(shard.name, generation, versions[name])
+		if nil == err {
+			if nil != firstErr {
+				glog.Warningf("Using generation %d of index shard '%s' instead.", generation, shard.name)
+			}
+			return entries, nil
+		} else if err == IndexNotFound {
+			// The generation was deleted since it was listed.
+			continue
+		}
+
+		glog.Warningf("Failed to read generation %d of index shard '%s': %v", generation, shard.name, err)
+		if nil == firstErr {
+			firstErr = err
+		}
+	}
+
+	if nil == firstErr {
+		// All generations were deleted since they were listed.
+		return make(map[string]indexEntry), nil
+	}
+
+	return nil, firstErr
+}
+
+// readShardGenerations only reads the generations of the index shards, but not
+// their entries. This is used to rebuild the index, replacing all shards.
+func (i *Index) readShardGenerations() error {
+	versions, err := i.archive.storageProvider.ListIndexShards()
+	if nil != err {
+		return err
+	}
+	delete(versions, LegacyIndexShard)
+
+	// This happens during initialization, so there is no need for locking.
+	i.readGenerations(versions)
+	i.rewrite = true
+	i.dirty.Store(true)
+
+	return nil
+}
+
+// readLegacyIndex reads the monolithic index written by earlier versions. The
+// index is split into shards when it is written the next time.
+func (i *Index) readLegacyIndex() error {
+	entries, err := i.readShard(LegacyIndexShard, 0, "")
 	if nil != err {
-		glog.Errorf("error reading index from provider: %v", err)
 		return err
 	}
+
+	// This happens during initialization, so there is no need for locking.
+	for key, value := range entries {
+		i.shardFor(key).entries[key] = value
+	}
+	i.rewrite = true
+	glog.Info("The archive has a legacy index, which is split into shards when it is written next.")
+
+	return nil
+}
+
+// readShard reads the entries of the given generation of an index shard. When
+// the given known version of the generation is cached locally, the cached copy
+// is read; otherwise the generation is read from the backup destination and
+// added to the cache.
+func (i *Index) readShard(name string, generation int, known Version) (map[string]indexEntry, error) {
+	if r, found := i.cache.open(name, known); found {
+		defer r.Close()
+
+		entries, err := i.decodeShard(r)
+		if nil == err {
+			glog.V(1).Infof("Using cached copy of index shard '%s'.", name)
+			return entries, nil
+		}
+
+		glog.Warningf("Failed to read cached index shard '%s', reading it from the backup destination: %v",
+			name, err)
+	}
+
+	r, version, err := i.archive.storageProvider.ReadIndex(generationName(name, generation))
+	if nil != err {
+		if err != IndexNotFound {
+			glog.Errorf("error reading index shard '%s' from provider: %v", name, err)
+		}
+		return nil, err
+	}
 	defer r.Close()
 
+	var cw *indexCacheWriter
+	if LegacyIndexShard != name {
+		cw = i.cache.newWriter(name)
+	}
+	if nil == cw {
+		return i.decodeShard(r)
+	}
+
+	tr := io.TeeReader(r, cw)
+	entries, err := i.decodeShard(tr)
+	if nil == err {
+		// Make sure the cached copy is complete.
+		_, err = io.Copy(io.Discard, tr)
+	}
+	if nil != err {
+		cw.Discard()
+		return nil, err
+	}
+	cw.Commit(version)
+
+	return entries, nil
+}
+
+// decodeShard decrypts and decompresses the entries of an index shard.
+func (i *Index) decodeShard(r io.Reader) (map[string]indexEntry, error) {
 	// Decrypt the stream holding the index ...
 	cr, err := i.archive.cryptoContext.Decrypt(r)
 	if nil != err {
-		glog.Errorf("error decrypting index from provider: %v", err)
-		return err
+		glog.Errorf("error decrypting index: %v", err)
+		return nil, err
 	}
 
 	// ... and decompress it.
 	gr, err := gzip.NewReader(cr)
 	if nil != err {
 		if err == gzip.ErrHeader {
-			return IndexDecryptionFailed
+			return nil, IndexDecryptionFailed
 		}
 
-		glog.Errorf("error decompressing index from provider: %v", err)
-		return err
+		glog.Errorf("error decompressing index: %v", err)
+		return nil, err
 	}
 	defer gr.Close()
 
+	entries := make(map[string]indexEntry)
 	for {
 		entry, err := readIndexEntry(gr)
 		if nil != err {
-			return err
+			return nil, err
 		} else if nil == entry {
 			break
 		}
 
-		// We do this outside of the entries map message handler because it
-		// happens during startup and the handler doesn't need to be running
-		// yet.
-		i.entries[entry.RelPath] = indexEntry{
+		entries[entry.RelPath] = indexEntry{
 			EntryMetadata: entry.EntryMetadata,
 			EntryFlags:    EntryFlagsPresentInBackup,
 		}
 	}
 
-	return nil
+	return entries, nil
 }
 
-// writeIndex writes the index. The caller *must* make sure that this is only
-// called when message handling hasn't started, has finished, or is "paused"
-// e.g. with the help of a `syncMessage` or the maintenance timer.
+// writeIndex writes the shards of the index that changed. The index can be
+// modified concurrently; such modifications are written by the next call.
 func (i *Index) writeIndex() error {
-	w, err := i.archive.storageProvider.NewIndexWriter()
+	i.writeMutex.Lock()
+	defer i.writeMutex.Unlock()
+
+	if err := i.archive.checkLock(); nil != err {
+		return err
+	}
+
+	// Clear the dirty flag first, so that modifications made while writing
+	// mark the index dirty again.
+	i.dirty.Store(false)
+
+	var firstErr error
+	numShards, numEntries := 0, 0
+
+	for _, shard := range i.dirtyShards() {
+		numShardEntries, err := i.writeShard(shard)
+		if nil != err {
+			glog.Errorf("The archive index shard '%s' could not be uploaded: %v", shard.name, err)
+			if nil == firstErr {
+				firstErr = err
+			}
+			continue
+		}
+
+		numShards++
+		numEntries += numShardEntries
+	}
+	if nil != firstErr {
+		i.dirty.Store(true)
+		return firstErr
+	}
+
+	if i.rewrite {
+		err := i.archive.storageProvider.DeleteIndex(LegacyIndexShard)
+		if nil != err && err != IndexNotFound {
+			i.dirty.Store(true)
+			return err
+		}
+		i.rewrite = false
+	}
+
+	glog.Infof("%d archive index shard(s) with %d file(s) uploaded.", numShards, numEntries)
+
+	return nil
+}
+
+// writeShard writes the given shard as a new generation and returns the number
+// of entries written. When another generation was written concurrently, the
+// concurrent changes are merged with the local changes and writing is
+// attempted again. Only the most recent generations are kept.
+func (i *Index) writeShard(shard *indexShard) (int, error) {
+	for attempt := 1; ; attempt++ {
+		entries, generation, changes := shard.takeChanges()
+		err := i.uploadShard(shard.name, generation, entries)
+		if nil == err {
+			obsolete := shard.addGeneration(generation, i.archive.options.indexGenerations())
+			i.deleteGenerations(shard.name, obsolete)
+			return len(entries), nil
+		}
+
+		shard.restoreChanges(changes)
+		if !errors.Is(err, IndexConflict) {
+			return 0, err
+		} else if attempt >= maxIndexWriteAttempts {
+			glog.Errorf("The archive index shard '%s' kept changing concurrently, giving up after %d attempts.",
+				shard.name, attempt)
+			return 0, err
+		}
+
+		glog.Warningf("The archive index shard '%s' was changed concurrently, merging the changes.",
+			shard.name)
+		if err := i.mergeRemoteShard(shard); nil != err {
+			return 0, err
+		}
+	}
+}
+
+// deleteGenerations deletes obsolete generations of a shard. Failures are only
+// logged, since they are deleted again with the next generation.
+func (i *Index) deleteGenerations(name string, generations []int) {
+	for _, generation := range generations {
+		err := i.archive.storageProvider.DeleteIndex(generationName(name, generation))
+		if nil != err && err != IndexNotFound {
+			glog.Warningf("Failed to delete generation %d of index shard '%s': %v", generation, name, err)
+		}
+	}
+}
+
+// mergeRemoteShard merges the generations of the shard written concurrently
+// with the local changes. For entries changed on both sides, the most recent
+// one wins.
+func (i *Index) mergeRemoteShard(shard *indexShard) error {
+	shard.mutex.RLock()
+	next := shard.nextGeneration()
+	shard.mutex.RUnlock()
+
+	// Read the generations written concurrently, up to the newest one.
+	var remote map[string]indexEntry
+	generations := []int{}
+	for generation := next; ; generation++ {
+		entries, err := i.readShard(shard.name, generation, "")
+		if err == IndexNotFound {
+			break
+		}
+
+		generations = append(generations, generation)
+		if nil != err {
+			glog.Warningf("Failed to read generation %d of index shard '%s': %v", generation, shard.name, err)
+			continue
+		}
+		remote = entries
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.generations = append(shard.generations, generations...)
+	if nil == remote {
+		// None of the concurrently written generations could be read, so keep
+		// what we have.
+		return nil
+	}
+
+	for key, remoteEntry := range remote {
+		// Whether a file is present locally is only known to us.
+		if local, found := shard.entries[key]; found {
+			remoteEntry.EntryFlags |= local.EntryFlags & EntryFlagsPresentInLocal
+			remote[key] = remoteEntry
+		}
+	}
+
+	for key, change := range shard.changes {
+		remoteEntry, found := remote[key]
+		if found && remoteEntry.Timestamp > change.Timestamp {
+			// Someone else backed up a more recent version meanwhile.
+			continue
+		}
+
+		if change.deleted {
+			delete(remote, key)
+		} else {
+			remote[key] = change.indexEntry
+		}
+	}
+
+	shard.entries = remote
+
+	return nil
+}
+
+// uploadShard writes the entries of a shard to the backup destination as the
+// given generation, unless that generation was written concurrently.
+func (i *Index) uploadShard(
+	name string,
+	generation int,
+	entries map[string]indexEntry,
+) (err error) {
+	w, err := i.archive.storageProvider.NewIndexWriter(generationName(name, generation), "")
 	if nil != err {
 		return err
 	}
-	defer w.Close()
+	// Don't store an incomplete generation when writing it fails.
+	defer func() {
+		if nil != err {
+			Abort(w)
+		}
+	}()
+
+	// Keep a copy of the shard in the cache, so it needn't be downloaded again.
+	var target io.Writer = w
+	cache := i.cache.newWriter(name)
+	if nil != cache {
+		defer cache.Discard()
+		target = io.MultiWriter(w, cache)
+	}
 
 	// ... and then encrypt it.
-	cw, err := i.archive.cryptoContext.Encrypt(w)
+	cw, err := i.archive.cryptoContext.Encrypt(target)
 	if nil != err {
 		return err
 	}
-	defer cw.Close()
 
 	// Compress the data in the index ...
 	gw := gzip.NewWriter(cw)
-	defer gw.Close()
 
-	numEntries := 0
-	// We require the caller to take care of sync.
-	err = i.walkIndex(func(e domain.Entry, ef EntryFlags) error {
-		numEntries++
-		return writeIndexEntry(e, gw)
-	})
+	for key, value := range entries {
+		entry := domain.Entry{
+			RelPath:       key,
+			EntryMetadata: value.EntryMetadata,
+		}
 
-	glog.Infof("Archive index with %d file(s) uploaded.", numEntries)
-	i.dirty = false
+		if err = writeIndexEntry(entry, gw); nil != err {
+			break
+		}
+	}
+	if nil == err {
+		err = gw.Close()
+	}
+	if nil == err {
+		err = cw.Close()
+	}
+	// Closing the index writer is when providers finish the upload.
+	if nil == err {
+		err = w.Close()
+	}
+	if nil != err {
+		return err
+	}
 
-	return err
+	glog.V(1).Infof("Generation %d of archive index shard '%s' with %d file(s) uploaded.",
+		generation, name, len(entries))
+	if nil != cache {
+		cache.Commit(w.Version())
+	}
+
+	return nil
 }
 
 func readIndexEntry(r io.Reader) (*domain.Entry, error) {
@@ -115,7 +508,14 @@ func readIndexEntry(r io.Reader) (*domain.Entry, error) {
 	return &domain.Entry{
 		RelPath: *entry.RelPath,
 		EntryMetadata: domain.EntryMetadata{
-			Timestamp: *entry.LastModified,
+			Timestamp:  *entry.LastModified,
+			Size:       entry.GetSize(),
+			StoredSize: entry.GetStoredSize(),
+			Digest:     entry.GetDigest(),
+			BlobID:     entry.GetBlobId(),
+			BackupTime: entry.GetBackupTime(),
+			TrashTime:  entry.GetTrashTime(),
+			Stream:     entry.GetStream(),
 		},
 	}, nil
 }
@@ -144,6 +544,27 @@ func marshalEntry(e domain.Entry) ([]byte, error) {
 	entry := &domain.IndexEntry{
 		RelPath:      proto.String(e.RelPath),
 		LastModified: proto.Int64(e.Timestamp),
+		Digest:       e.Digest,
+	}
+
+	// Only write what's known, to keep the index small for old entries.
+	if 0 != e.Size {
+		entry.Size = proto.Int64(e.Size)
+	}
+	if 0 != e.StoredSize {
+		entry.StoredSize = proto.Int64(e.StoredSize)
+	}
+	if "" != e.BlobID {
+		entry.BlobId = proto.String(e.BlobID)
+	}
+	if 0 != e.BackupTime {
+		entry.BackupTime = proto.Int64(e.BackupTime)
+	}
+	if 0 != e.TrashTime {
+		entry.TrashTime = proto.Int64(e.TrashTime)
+	}
+	if e.Stream {
+		entry.Stream = proto.Bool(true)
 	}
 
 	data, err := proto.Marshal(entry)
@@ -0,0 +1,144 @@
+package archiving
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rokeller/bart/domain"
+)
+
+const testPassword = "test password"
+
+func newTestArchive(t testing.TB, p StorageProvider) Archive {
+	t.Helper()
+
+	return NewArchive(testPassword, NewLocalContext(t.TempDir()), p, Options{})
+}
+
+func newTestEntry(relPath string) domain.Entry {
+	return domain.Entry{
+		RelPath: relPath,
+		EntryMetadata: domain.EntryMetadata{
+			Timestamp: 1700000000,
+			Size:      42,
+		},
+	}
+}
+
+// requireEntries fails the test unless all the given relative paths are in the
+// archive.
+func requireEntries(t *testing.T, a Archive, relPaths []string) {
+	t.Helper()
+
+	missing := 0
+	for _, relPath := range relPaths {
+		if nil == a.GetEntry(relPath) {
+			missing++
+		}
+	}
+	if missing > 0 {
+		t.Fatalf("%d of %d entries are missing from the index", missing, len(relPaths))
+	}
+}
+
+func TestIndexMigrationInterrupted(t *testing.T) {
+	p := newMemoryProvider()
+	p.failIndexWritesAfter(-1)
+
+	// Write a legacy index, like earlier versions did.
+	relPaths := []string{}
+	entries := map[string]indexEntry{}
+	for n := 0; n < 1000; n++ {
+		relPath := fmt.Sprintf("dir/file-%d", n)
+		relPaths = append(relPaths, relPath)
+		entries[relPath] = indexEntry{EntryMetadata: newTestEntry(relPath).EntryMetadata}
+	}
+	a := newTestArchive(t, p)
+	if err := a.index.uploadShard(LegacyIndexShard, 0, entries); nil != err {
+		t.Fatalf("writing the legacy index failed: %v", err)
+	}
+	if err := a.Close(); nil != err {
+		t.Fatalf("closing the archive failed: %v", err)
+	}
+
+	// Interrupt splitting the legacy index into shards after a few shards.
+	a = newTestArchive(t, p)
+	requireEntries(t, a, relPaths)
+	a.index.setEntry(newTestEntry("new-file"), EntryFlagsPresentInBackup, true)
+	p.failIndexWritesAfter(10)
+	if err := a.Close(); nil == err {
+		t.Fatal("closing the archive succeeded although writing the index failed")
+	}
+
+	shards, _ := p.ListIndexShards()
+	if _, found := shards[LegacyIndexShard]; !found {
+		t.Fatal("the legacy index was deleted although the migration failed")
+	} else if len(shards) != 11 {
+		t.Fatalf("expected 10 shards and the legacy index, got %d", len(shards))
+	}
+
+	// The entries of the shards that were not written must not be lost.
+	p.failIndexWritesAfter(-1)
+	a = newTestArchive(t, p)
+	requireEntries(t, a, relPaths)
+
+	// Completing the migration deletes the legacy index.
+	a.index.setEntry(newTestEntry("new-file"), EntryFlagsPresentInBackup, true)
+	if err := a.Close(); nil != err {
+		t.Fatalf("closing the archive failed: %v", err)
+	}
+
+	shards, _ = p.ListIndexShards()
+	if _, found := shards[LegacyIndexShard]; found {
+		t.Fatal("the legacy index was not deleted after the migration")
+	}
+
+	a = newTestArchive(t, p)
+	requireEntries(t, a, append(relPaths, "new-file"))
+}
+
+func TestIndexConcurrentChangesMerged(t *testing.T) {
+	p := newMemoryProvider()
+	p.failIndexWritesAfter(-1)
+
+	a := newTestArchive(t, p)
+	a.index.setEntry(newTestEntry("shared"), EntryFlagsPresentInBackup, true)
+	if err := a.Close(); nil != err {
+		t.Fatalf("closing the archive failed: %v", err)
+	}
+
+	// Two runs read the same index and change it independently.
+	first, second := newTestArchive(t, p), newTestArchive(t, p)
+	firstPaths, secondPaths := []string{}, []string{}
+	for n := 0; n < 1000; n++ {
+		firstPaths = append(firstPaths, fmt.Sprintf("first/file-%d", n))
+		first.index.setEntry(newTestEntry(firstPaths[n]), EntryFlagsPresentInBackup, true)
+		secondPaths = append(secondPaths, fmt.Sprintf("second/file-%d", n))
+		second.index.setEntry(newTestEntry(secondPaths[n]), EntryFlagsPresentInBackup, true)
+	}
+
+	// The most recent version of an entry changed by both wins, no matter
+	// which run writes the index last.
+	shared := newTestEntry("shared")
+	shared.Timestamp += 10
+	first.index.setEntry(shared, EntryFlagsPresentInBackup, true)
+	stale := newTestEntry("shared")
+	stale.Timestamp += 5
+	second.index.setEntry(stale, EntryFlagsPresentInBackup, true)
+
+	if err := first.Close(); nil != err {
+		t.Fatalf("closing the first archive failed: %v", err)
+	}
+	if err := second.Close(); nil != err {
+		t.Fatalf("closing the second archive failed: %v", err)
+	}
+	if 0 == p.conflicts {
+		t.Fatal("the concurrent changes didn't conflict")
+	}
+
+	a = newTestArchive(t, p)
+	requireEntries(t, a, append(firstPaths, secondPaths...))
+	if entry := a.GetEntry("shared"); nil == entry || shared.Timestamp != entry.Timestamp {
+		t.Errorf("got entry %v for 'shared', want timestamp %d", entry, shared.Timestamp)
+	}
+}
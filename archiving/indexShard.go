@@ -0,0 +1,172 @@
+package archiving
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rokeller/bart/domain"
+)
+
+// indexShardCount is the number of shards of the index.
+const indexShardCount = 256
+
+// indexShard holds the entries of the index whose relative path hashes start
+// with the same byte. Each shard is stored separately in the backup
+// destination, so checkpoints only need to upload the shards that changed.
+// Each shard guards its entries with its own lock, so different shards can be
+// accessed concurrently.
+type indexShard struct {
+	mutex   sync.RWMutex
+	name    string
+	entries map[string]indexEntry
+	// changes tracks the changes to entries since the shard was last read or
+	// written, so they can be merged with concurrent changes by others.
+	changes map[string]indexChange
+	// generations lists the generations of the shard in the backup
+	// destination, oldest first. The entries are based on the newest one that
+	// could be read.
+	generations []int
+}
+
+// indexChange tracks a change to an entry made since the index was last read
+// from or written to the backup destination.
+type indexChange struct {
+	indexEntry
+	deleted bool
+}
+
+func newIndexShard(name string) *indexShard {
+	return &indexShard{
+		name:    name,
+		entries: make(map[string]indexEntry),
+		changes: make(map[string]indexChange),
+	}
+}
+
+// shardName determines the name of the shard holding the given relative path.
+func shardName(relPath string) string {
+	entry := domain.Entry{RelPath: relPath}
+	return entry.Hash()[0:2]
+}
+
+// shardFor gets the shard holding the given relative path.
+func (i *Index) shardFor(relPath string) *indexShard {
+	return i.shards[shardName(relPath)]
+}
+
+// dirtyShards finds the shards that need to be written.
+func (i *Index) dirtyShards() []*indexShard {
+	shards := []*indexShard{}
+	for _, shard := range i.shards {
+		shard.mutex.RLock()
+		dirty := len(shard.changes) > 0 ||
+			(i.rewrite && (len(shard.entries) > 0 || len(shard.generations) > 0))
+		shard.mutex.RUnlock()
+
+		if dirty {
+			shards = append(shards, shard)
+		}
+	}
+
+	return shards
+}
+
+// snapshot creates a copy of the shard's entries.
+func (s *indexShard) snapshot() map[string]indexEntry {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshot := make(map[string]indexEntry, len(s.entries))
+	for key, value := range s.entries {
+		snapshot[key] = value
+	}
+
+	return snapshot
+}
+
+// takeChanges takes a snapshot of the shard's entries for writing it, along
+// with the generation to write it as and the changes it includes. The shard's
+// changes are reset, so that subsequent changes are tracked separately.
+func (s *indexShard) takeChanges() (map[string]indexEntry, int, map[string]indexChange) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := make(map[string]indexEntry, len(s.entries))
+	for key, value := range s.entries {
+		snapshot[key] = value
+	}
+
+	changes := s.changes
+	s.changes = make(map[string]indexChange)
+
+	return snapshot, s.nextGeneration(), changes
+}
+
+// restoreChanges restores changes taken earlier which could not be written,
+// unless they have been superseded by more recent changes meanwhile.
+func (s *indexShard) restoreChanges(changes map[string]indexChange) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, change := range changes {
+		if _, found := s.changes[key]; !found {
+			s.changes[key] = change
+		}
+	}
+}
+
+// nextGeneration determines the generation to write the shard as next.
+func (s *indexShard) nextGeneration() int {
+	if len(s.generations) == 0 {
+		return 1
+	}
+
+	return s.generations[len(s.generations)-1] + 1
+}
+
+// addGeneration records a generation of the shard written to the backup
+// destination, and returns the generations beyond the given number of
+// generations to keep, which are to be deleted.
+func (s *indexShard) addGeneration(generation, keep int) []int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.generations = append(s.generations, generation)
+	if len(s.generations) <= keep {
+		return nil
+	}
+
+	obsolete := s.generations[:len(s.generations)-keep]
+	s.generations = append([]int{}, s.generations[len(s.generations)-keep:]...)
+
+	return obsolete
+}
+
+// generationName determines the name under which the given generation of a
+// shard is stored. Generation 0 denotes shards written by earlier versions,
+// which only kept a single generation.
+func generationName(shard string, generation int) string {
+	if 0 == generation {
+		return shard
+	}
+
+	return fmt.Sprintf("%s-%d", shard, generation)
+}
+
+// parseGenerationName parses the name under which a generation of a shard is
+// stored.
+func parseGenerationName(name string) (string, int, bool) {
+	shard, suffix, found := strings.Cut(name, "-")
+	if !found {
+		return name, 0, true
+	}
+
+	generation, err := strconv.Atoi(suffix)
+	if nil != err || generation < 1 {
+		return "", 0, false
+	}
+
+	return shard, generation, true
+}
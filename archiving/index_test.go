@@ -0,0 +1,179 @@
+package archiving
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/rokeller/bart/domain"
+)
+
+// benchmarkEntries is the number of entries in the index for benchmarks.
+const benchmarkEntries = 100_000
+
+var benchmarkIndex struct {
+	once    sync.Once
+	archive Archive
+	entries []domain.Entry
+}
+
+// newBenchmarkIndex creates an index with benchmarkEntries entries. Deriving the
+// key is slow, so the index is shared by all benchmarks.
+func newBenchmarkIndex(b *testing.B) (*Index, []domain.Entry) {
+	benchmarkIndex.once.Do(func() {
+		benchmarkIndex.archive = newTestArchive(b, newMemoryProvider())
+		for n := 0; n < benchmarkEntries; n++ {
+			entry := newTestEntry(fmt.Sprintf("dir-%d/file-%d", n%100, n))
+			benchmarkIndex.entries = append(benchmarkIndex.entries, entry)
+			benchmarkIndex.archive.index.setEntry(entry, EntryFlagsPresentInBackup, false)
+		}
+	})
+
+	return benchmarkIndex.archive.index, benchmarkIndex.entries
+}
+
+// runParallel runs fn in parallel for the entries, spreading the goroutines
+// over the entries.
+func runParallel(b *testing.B, entries []domain.Entry, fn func(domain.Entry)) {
+	next := &atomic.Int64{}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		n := int(next.Add(7919))
+		for pb.Next() {
+			fn(entries[n%len(entries)])
+			n++
+		}
+	})
+}
+
+func BenchmarkIndexNeedsBackup(b *testing.B) {
+	index, entries := newBenchmarkIndex(b)
+
+	b.Run("sharded", func(b *testing.B) {
+		runParallel(b, entries, func(entry domain.Entry) {
+			index.needsBackup(entry)
+		})
+	})
+	b.Run("message-loop", func(b *testing.B) {
+		loop := newMessageLoopIndex(entries)
+		defer loop.close()
+
+		runParallel(b, entries, func(entry domain.Entry) {
+			loop.needsBackup(entry)
+		})
+	})
+}
+
+func BenchmarkIndexGetEntry(b *testing.B) {
+	index, entries := newBenchmarkIndex(b)
+
+	b.Run("sharded", func(b *testing.B) {
+		runParallel(b, entries, func(entry domain.Entry) {
+			index.getEntry(entry.RelPath)
+		})
+	})
+	b.Run("message-loop", func(b *testing.B) {
+		loop := newMessageLoopIndex(entries)
+		defer loop.close()
+
+		runParallel(b, entries, func(entry domain.Entry) {
+			loop.getEntry(entry.RelPath)
+		})
+	})
+}
+
+func BenchmarkIndexSetEntry(b *testing.B) {
+	index, entries := newBenchmarkIndex(b)
+
+	b.Run("sharded", func(b *testing.B) {
+		runParallel(b, entries, func(entry domain.Entry) {
+			index.setEntry(entry, EntryFlagsPresentInBackup, false)
+		})
+	})
+	b.Run("message-loop", func(b *testing.B) {
+		loop := newMessageLoopIndex(entries)
+		defer loop.close()
+
+		runParallel(b, entries, func(entry domain.Entry) {
+			loop.setEntry(entry, EntryFlagsPresentInBackup)
+		})
+	})
+}
+
+// messageLoopIndex mimics the index of earlier versions, whose entries were
+// only accessed by a single goroutine handling messages, as the baseline for
+// the benchmarks. Like the original, setting an entry doesn't wait for the
+// message to be handled, while getting one waits for the result.
+type messageLoopIndex struct {
+	entries  map[string]indexEntry
+	messages chan func()
+	wg       *sync.WaitGroup
+}
+
+func newMessageLoopIndex(entries []domain.Entry) messageLoopIndex {
+	i := messageLoopIndex{
+		entries:  make(map[string]indexEntry, len(entries)),
+		messages: make(chan func(), 10),
+		wg:       &sync.WaitGroup{},
+	}
+	for _, entry := range entries {
+		i.entries[entry.RelPath] = indexEntry{
+			EntryMetadata: entry.EntryMetadata,
+			EntryFlags:    EntryFlagsPresentInBackup,
+		}
+	}
+
+	i.wg.Add(1)
+	go func() {
+		defer i.wg.Done()
+		for fn := range i.messages {
+			fn()
+		}
+	}()
+
+	return i
+}
+
+func (i messageLoopIndex) close() {
+	close(i.messages)
+	i.wg.Wait()
+}
+
+func (i messageLoopIndex) getEntry(relPath string) *indexEntry {
+	// Like the original, the result is handed over on an unbuffered channel.
+	result := make(chan *indexEntry)
+	i.messages <- func() {
+		if entry, found := i.entries[relPath]; found {
+			result <- &entry
+		} else {
+			result <- nil
+		}
+	}
+
+	return <-result
+}
+
+func (i messageLoopIndex) setEntry(entry domain.Entry, flags EntryFlags) {
+	i.messages <- func() {
+		i.entries[entry.RelPath] = indexEntry{
+			EntryMetadata: entry.EntryMetadata,
+			EntryFlags:    flags,
+		}
+	}
+}
+
+func (i messageLoopIndex) needsBackup(entry domain.Entry) bool {
+	existing := i.getEntry(entry.RelPath)
+	found := nil != existing
+
+	backupNeeded := !found ||
+		(existing.EntryFlags&EntryFlagsPresentInBackup) == EntryFlagsNone ||
+		existing.Timestamp < entry.Timestamp
+
+	if found {
+		i.setEntry(entry, existing.EntryFlags|EntryFlagsPresentInLocal)
+	}
+
+	return backupNeeded
+}
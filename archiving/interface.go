@@ -2,8 +2,9 @@ package archiving
 
 import (
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"time"
 
 	"github.com/rokeller/bart/domain"
 )
@@ -20,34 +21,186 @@ var IndexNotFound = errors.New("the index was not found in the backup destinatio
 // an archive's index failed, most likely due to a wrong crypto key.
 var IndexDecryptionFailed = errors.New("decryption of the archive index failed")
 
+// IndexConflict defines the error that is raised when the index could not be
+// written because it was changed by someone else since it was read.
+var IndexConflict = errors.New("the index was changed concurrently")
+
+// DigestMismatch defines the error that is raised when a restored file does not
+// match the digest recorded when it was backed up.
+var DigestMismatch = errors.New("the restored file does not match its digest from the backup")
+
+// BlobHeaderInvalid defines the error that is raised when the header of a backup
+// file cannot be read.
+var BlobHeaderInvalid = errors.New("the header of the backup file is invalid")
+
+// BlobHeaderMissing defines the error that is raised when a backup file has no
+// header, e.g. because it was written by an earlier version.
+var BlobHeaderMissing = errors.New("the backup file has no header")
+
+// BlobTrailerInvalid defines the error that is raised when the trailer of a
+// backup file cannot be read, e.g. because the backup file is truncated.
+var BlobTrailerInvalid = errors.New("the trailer of the backup file is invalid")
+
 // BackupFileNotFound defines the error that is raised when a file is not found
 // in the backup archive.
 var BackupFileNotFound = errors.New("the file was not found in the backup")
 
+// RunRecordNotFound defines the error that is raised when a run record is not
+// found in the backup archive.
+var RunRecordNotFound = errors.New("the run record was not found in the backup")
+
+// RunRecordIDInvalid defines the error that is raised when the ID of a run
+// record is not one created by NewRunRecordID.
+var RunRecordIDInvalid = errors.New("the run record ID is invalid")
+
+// ArchiveLocked defines the error that is raised when the archive lock cannot
+// be acquired because another process holds it.
+var ArchiveLocked = errors.New("the archive is locked")
+
+// ArchiveLockLost defines the error that is raised when the archive must not be
+// modified anymore, because its lock was lost.
+var ArchiveLockLost = errors.New("the archive lock was lost")
+
+// RootNotMapped defines the error that is raised when a file belongs to a root
+// that is not mapped to a local directory.
+var RootNotMapped = errors.New("the root of the file is not mapped to a local directory")
+
+// Lock is an exclusive lock on an archive.
+type Lock interface {
+	// Release releases the lock.
+	Release() error
+	// Err returns the error that made the lock get lost, e.g. because it could
+	// not be renewed in time, or nil while the lock is held.
+	Err() error
+}
+
+// TransientError wraps an error raised by a storage provider for a failure
+// that is expected to go away by itself, like a throttled request or a network
+// glitch. RetryAfter holds the delay the backup destination asked for before
+// the next attempt, if any.
+type TransientError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+// Error implements error.
+func (e TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error.
+func (e TransientError) Unwrap() error {
+	return e.Err
+}
+
+// LockedError is the error raised when the archive lock is held by the given
+// owner. It wraps ArchiveLocked.
+type LockedError struct {
+	Owner string
+}
+
+// Error implements error.
+func (e LockedError) Error() string {
+	return fmt.Sprintf("%v by %s", ArchiveLocked, e.Owner)
+}
+
+// Unwrap returns ArchiveLocked.
+func (e LockedError) Unwrap() error {
+	return ArchiveLocked
+}
+
+// Version identifies a version of an object in the backup destination, like an
+// ETag. The empty Version stands for an object that does not exist.
+type Version string
+
+// VersionedWriteCloser is an io.WriteCloser that knows the version of the
+// object it has written once it is closed.
+type VersionedWriteCloser interface {
+	io.WriteCloser
+	// Version returns the version of the written object. It must only be
+	// called after Close succeeded.
+	Version() Version
+}
+
+// AbortableWriter is implemented by writers that only store what was written to
+// them when they are closed, and can discard it instead, e.g. when writing
+// failed part way through.
+type AbortableWriter interface {
+	// Abort discards what was written. Closing the writer afterwards has no
+	// effect.
+	Abort()
+}
+
+// Abort discards what was written to the given writer, so that incomplete data
+// is not stored. Writers that cannot abort are closed instead.
+func Abort(w io.WriteCloser) {
+	if aw, ok := w.(AbortableWriter); ok {
+		aw.Abort()
+	} else {
+		w.Close()
+	}
+}
+
+// BackupFileInfo describes a backup file in the backup destination.
+type BackupFileInfo struct {
+	// BlobID identifies the backup file; it is the hash of the relative path
+	// of the file it was backed up from.
+	BlobID string
+	// Size is the size of the (encrypted) backup file.
+	Size int64
+	// Modified is the time the backup file was last written.
+	Modified time.Time
+}
+
+// LegacyIndexShard is the name of the monolithic index written by earlier
+// versions. Current versions split the index into shards named by the first
+// byte (as two hex digits) of the hash of the relative paths they hold, and
+// keep several generations of each shard, named like '<shard>-<generation>'.
+const LegacyIndexShard = ""
+
 type StorageProvider interface {
 	// When the backup destination does not have settings yet, the error must
 	// be archiving.SettingsNotFound{}.
 	ReadSettings() (io.ReadCloser, error)
-	// When the backup destination does not have an index yet, the error must
-	// be archiving.IndexNotFound{}.
-	ReadIndex() (io.ReadCloser, error)
+	// ListIndexShards lists the index shards in the backup destination with
+	// their versions, including the LegacyIndexShard if it exists.
+	ListIndexShards() (map[string]Version, error)
+	// When the backup destination does not have the index shard, the error
+	// must be archiving.IndexNotFound{}.
+	ReadIndex(shard string) (io.ReadCloser, Version, error)
+	// ReadBackupFile, WriteBackupFile and DeleteBackupFile address the backup
+	// file of the entry by archiving.BlobID.
 	ReadBackupFile(entry domain.Entry) (io.ReadCloser, error)
+	ReadBackupFileByID(blobID string) (io.ReadCloser, error)
+	// When the run record does not exist, the error must be
+	// archiving.RunRecordNotFound.
+	ReadRunRecord(id string) (io.ReadCloser, error)
+	ListRunRecords() ([]string, error)
 
 	NewSettingsWriter() (io.WriteCloser, error)
-	NewIndexWriter() (io.WriteCloser, error)
-	WriteBackupFile(entry domain.Entry, file *os.File) error
+	// NewIndexWriter creates a writer for an index shard, which must only
+	// replace the shard if it still has the expected version when the writer
+	// is closed. Otherwise, closing the writer must fail with
+	// archiving.IndexConflict.
+	NewIndexWriter(shard string, expected Version) (VersionedWriteCloser, error)
+	WriteBackupFile(entry domain.Entry, r io.ReadSeeker) error
+	NewRunRecordWriter(id string) (io.WriteCloser, error)
 
 	DeleteSettings() error
-	DeleteIndex() error
+	DeleteIndex(shard string) error
+	// ListBackupFiles calls fn for every backup file in the backup
+	// destination, until fn returns an error.
+	ListBackupFiles(fn func(BackupFileInfo) error) error
+	// When the backup file does not exist, the error must be
+	// archiving.BackupFileNotFound.
+	DeleteBackupFileByID(blobID string) error
 	DeleteBackupFile(entry domain.Entry) error
-}
-
-type LocalContext struct {
-	rootDir string
-}
+	DeleteRunRecord(id string) error
 
-func NewLocalContext(rootDir string) LocalContext {
-	return LocalContext{
-		rootDir: rootDir,
-	}
+	// AcquireLock acquires the exclusive lock on the archive for the given
+	// owner. When the lock is held, the error must be an archiving.LockedError
+	// with the owner holding it.
+	AcquireLock(owner string) (Lock, error)
+	// BreakLock forcibly removes the archive's lock, no matter who holds it.
+	BreakLock() error
 }
@@ -0,0 +1,95 @@
+package archiving
+
+import (
+	"path"
+	"strings"
+)
+
+// LocalContext maps the relative paths in the archive index to local paths. An
+// archive either has a single root, whose files are indexed by their path
+// relative to it, or several named roots, whose files are indexed as
+// '/<root>/<relative path>'.
+type LocalContext struct {
+	// roots maps the names of the roots to their local directories; the single
+	// root has an empty name.
+	roots map[string]string
+}
+
+// NewLocalContext creates a local context for the single root at the given
+// directory.
+func NewLocalContext(rootDir string) LocalContext {
+	return LocalContext{
+		roots: map[string]string{"": rootDir},
+	}
+}
+
+// NewMultiRootContext creates a local context for the given named roots, which
+// map the names of the roots to their local directories. The directories may
+// differ from the ones backed up, e.g. to restore a root to a new location.
+func NewMultiRootContext(roots map[string]string) LocalContext {
+	return LocalContext{
+		roots: roots,
+	}
+}
+
+// AbsPath determines the local path of the file with the given relative path.
+// It returns false when the file's root is not mapped to a local directory.
+func (c LocalContext) AbsPath(relPath string) (string, bool) {
+	root, rel := SplitRootedPath(relPath)
+	rootDir, found := c.roots[root]
+	if !found {
+		return "", false
+	}
+
+	return path.Join(rootDir, rel), true
+}
+
+// namedRoots returns the named roots of the context, i.e. all but the single
+// root.
+func (c LocalContext) namedRoots() map[string]string {
+	roots := map[string]string{}
+	for name, rootDir := range c.roots {
+		if "" != name {
+			roots[name] = rootDir
+		}
+	}
+
+	return roots
+}
+
+// withDefaultRoots returns a copy of the context that also maps the given roots
+// it doesn't map yet.
+func (c LocalContext) withDefaultRoots(defaults map[string]string) LocalContext {
+	roots := make(map[string]string, len(c.roots)+len(defaults))
+	for name, rootDir := range defaults {
+		roots[name] = rootDir
+	}
+	for name, rootDir := range c.roots {
+		roots[name] = rootDir
+	}
+
+	return LocalContext{
+		roots: roots,
+	}
+}
+
+// RootedPath determines the relative path in the archive index of a file with
+// the given path relative to the given named root.
+func RootedPath(root, relPath string) string {
+	if "" == root {
+		return relPath
+	}
+
+	return "/" + root + "/" + relPath
+}
+
+// SplitRootedPath splits the given relative path in the archive index into the
+// name of its root and the path relative to that root.
+func SplitRootedPath(relPath string) (string, string) {
+	if !strings.HasPrefix(relPath, "/") {
+		return "", relPath
+	}
+
+	root, rel, _ := strings.Cut(relPath[1:], "/")
+	return root, rel
+}
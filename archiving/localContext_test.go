@@ -0,0 +1,89 @@
+package archiving
+
+import "testing"
+
+func TestRootedPath(t *testing.T) {
+	tests := []struct {
+		root    string
+		relPath string
+		want    string
+	}{
+		{"", "a/b.txt", "a/b.txt"},
+		{"", "b.txt", "b.txt"},
+		{"docs", "a/b.txt", "/docs/a/b.txt"},
+		{"docs", "b.txt", "/docs/b.txt"},
+		{"my docs", "a b/c.txt", "/my docs/a b/c.txt"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.want, func(t *testing.T) {
+			rooted := RootedPath(test.root, test.relPath)
+			if rooted != test.want {
+				t.Errorf("RootedPath('%s', '%s') = '%s', want '%s'", test.root, test.relPath, rooted, test.want)
+			}
+
+			// Splitting the rooted path must give back the root and path.
+			root, relPath := SplitRootedPath(rooted)
+			if root != test.root || relPath != test.relPath {
+				t.Errorf("SplitRootedPath('%s') = '%s', '%s', want '%s', '%s'",
+					rooted, root, relPath, test.root, test.relPath)
+			}
+		})
+	}
+}
+
+func TestSplitRootedPath(t *testing.T) {
+	tests := []struct {
+		relPath     string
+		wantRoot    string
+		wantRelPath string
+	}{
+		{"a/b.txt", "", "a/b.txt"},
+		{"/docs/a/b.txt", "docs", "a/b.txt"},
+		{"/docs/", "docs", ""},
+		{"/docs", "docs", ""},
+		{"/", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.relPath, func(t *testing.T) {
+			root, relPath := SplitRootedPath(test.relPath)
+			if root != test.wantRoot || relPath != test.wantRelPath {
+				t.Errorf("SplitRootedPath('%s') = '%s', '%s', want '%s', '%s'",
+					test.relPath, root, relPath, test.wantRoot, test.wantRelPath)
+			}
+		})
+	}
+}
+
+func TestLocalContextAbsPath(t *testing.T) {
+	single := NewLocalContext("/home/me")
+	multi := NewMultiRootContext(map[string]string{"docs": "/home/me/docs", "photos": "/srv/photos"})
+
+	tests := []struct {
+		name      string
+		context   LocalContext
+		relPath   string
+		want      string
+		wantFound bool
+	}{
+		{"single root", single, "a/b.txt", "/home/me/a/b.txt", true},
+		{"named root in single root", single, "/docs/b.txt", "", false},
+		{"named root", multi, "/docs/a/b.txt", "/home/me/docs/a/b.txt", true},
+		{"other named root", multi, "/photos/c.jpg", "/srv/photos/c.jpg", true},
+		{"unmapped root", multi, "/music/d.mp3", "", false},
+		{"single root in named roots", multi, "a/b.txt", "", false},
+		{"default root", single.withDefaultRoots(map[string]string{"docs": "/old/docs"}), "/docs/b.txt", "/old/docs/b.txt", true},
+		{"default root not overriding", multi.withDefaultRoots(map[string]string{"docs": "/old/docs"}), "/docs/b.txt", "/home/me/docs/b.txt", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			absPath, found := test.context.AbsPath(test.relPath)
+			if absPath != test.want || found != test.wantFound {
+				t.Errorf("AbsPath('%s') = '%s', %v, want '%s', %v",
+					test.relPath, absPath, found, test.want, test.wantFound)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package archiving
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+func (a Archive) acquireLock() Lock {
+	lock, err := a.storageProvider.AcquireLock(lockOwner())
+	if errors.Is(err, ArchiveLocked) {
+		a.exit(fmt.Sprintf("Cannot get exclusive access to the archive: %v. "+
+			"If you are sure that no other process uses the archive, run 'bart unlock'.", err))
+	} else if nil != err {
+		a.exit(fmt.Sprintf("Failed to lock the archive: %v", err))
+	}
+
+	glog.V(1).Info("Acquired exclusive archive lock.")
+
+	return lock
+}
+
+// lockOwner describes this process as the owner of an archive lock.
+func lockOwner() string {
+	host, err := os.Hostname()
+	if nil != err {
+		host = "unknown host"
+	}
+
+	return fmt.Sprintf("%s (pid %d) since %s", host, os.Getpid(),
+		time.Now().Format(time.RFC3339))
+}
@@ -0,0 +1,219 @@
+package archiving
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rokeller/bart/domain"
+)
+
+// errNotSupported is returned by the operations the memory provider doesn't
+// support.
+var errNotSupported = errors.New("not supported by the memory provider")
+
+// errWriteFailed is returned when writing an index shard fails on purpose.
+var errWriteFailed = errors.New("writing the index shard failed")
+
+// memoryProvider is a StorageProvider that keeps the settings and the index in
+// memory, for testing.
+type memoryProvider struct {
+	mutex    sync.Mutex
+	settings []byte
+	shards   map[string][]byte
+	versions map[string]int
+	// indexWritesLeft is the number of index shard writes that succeed before
+	// all further writes fail; negative for no limit.
+	indexWritesLeft int
+	// conflicts is the number of index shard writes that failed because the
+	// shard was written concurrently.
+	conflicts int
+}
+
+func newMemoryProvider() *memoryProvider {
+	return &memoryProvider{
+		shards:   map[string][]byte{},
+		versions: map[string]int{},
+	}
+}
+
+// failIndexWritesAfter makes all index shard writes fail after the given
+// number of writes; negative to not fail.
+func (p *memoryProvider) failIndexWritesAfter(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.indexWritesLeft = n
+}
+
+func (p *memoryProvider) ReadSettings() (io.ReadCloser, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if nil == p.settings {
+		return nil, SettingsNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(p.settings)), nil
+}
+
+func (p *memoryProvider) ListIndexShards() (map[string]Version, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	versions := make(map[string]Version, len(p.shards))
+	for name := range p.shards {
+		versions[name] = p.version(name)
+	}
+
+	return versions, nil
+}
+
+func (p *memoryProvider) ReadIndex(shard string) (io.ReadCloser, Version, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	data, found := p.shards[shard]
+	if !found {
+		return nil, "", IndexNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), p.version(shard), nil
+}
+
+func (p *memoryProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser, error) {
+	return nil, errNotSupported
+}
+
+func (p *memoryProvider) ReadBackupFileByID(blobID string) (io.ReadCloser, error) {
+	return nil, errNotSupported
+}
+
+func (p *memoryProvider) ReadRunRecord(id string) (io.ReadCloser, error) {
+	return nil, RunRecordNotFound
+}
+
+func (p *memoryProvider) ListRunRecords() ([]string, error) {
+	return nil, nil
+}
+
+func (p *memoryProvider) NewSettingsWriter() (io.WriteCloser, error) {
+	return &memoryWriter{close: func(data []byte) error {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		p.settings = data
+		return nil
+	}}, nil
+}
+
+func (p *memoryProvider) NewIndexWriter(shard string, expected Version) (VersionedWriteCloser, error) {
+	w := &memoryWriter{}
+	w.close = func(data []byte) error {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if 0 == p.indexWritesLeft {
+			return errWriteFailed
+		} else if p.indexWritesLeft > 0 {
+			p.indexWritesLeft--
+		}
+
+		if _, found := p.shards[shard]; found && p.version(shard) != expected {
+			p.conflicts++
+			return IndexConflict
+		} else if !found && "" != expected {
+			p.conflicts++
+			return IndexConflict
+		}
+
+		p.shards[shard] = data
+		p.versions[shard]++
+		w.version = p.version(shard)
+		return nil
+	}
+
+	return w, nil
+}
+
+func (p *memoryProvider) WriteBackupFile(entry domain.Entry, r io.ReadSeeker) error {
+	return errNotSupported
+}
+
+func (p *memoryProvider) NewRunRecordWriter(id string) (io.WriteCloser, error) {
+	return nil, errNotSupported
+}
+
+func (p *memoryProvider) DeleteSettings() error {
+	return errNotSupported
+}
+
+func (p *memoryProvider) DeleteIndex(shard string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, found := p.shards[shard]; !found {
+		return IndexNotFound
+	}
+	delete(p.shards, shard)
+
+	return nil
+}
+
+func (p *memoryProvider) ListBackupFiles(fn func(BackupFileInfo) error) error {
+	return nil
+}
+
+func (p *memoryProvider) DeleteBackupFileByID(blobID string) error {
+	return BackupFileNotFound
+}
+
+func (p *memoryProvider) DeleteBackupFile(entry domain.Entry) error {
+	return BackupFileNotFound
+}
+
+func (p *memoryProvider) DeleteRunRecord(id string) error {
+	return RunRecordNotFound
+}
+
+func (p *memoryProvider) AcquireLock(owner string) (Lock, error) {
+	return nil, errNotSupported
+}
+
+func (p *memoryProvider) BreakLock() error {
+	return errNotSupported
+}
+
+// version determines the version of the given shard; the mutex must be held.
+func (p *memoryProvider) version(shard string) Version {
+	return Version(fmt.Sprintf("%d", p.versions[shard]))
+}
+
+// memoryWriter buffers what is written and hands it to close when it is
+// closed.
+type memoryWriter struct {
+	bytes.Buffer
+	close   func([]byte) error
+	closed  bool
+	version Version
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.close(w.Bytes())
+}
+
+// Abort implements AbortableWriter.
+func (w *memoryWriter) Abort() {
+	w.closed = true
+}
+
+func (w *memoryWriter) Version() Version {
+	return w.version
+}
@@ -0,0 +1,116 @@
+package archiving
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy defines which runs to keep in the archive's history. A run is
+// kept if any of the rules keeps it. The rules are applied to the runs of each
+// command separately.
+type RetentionPolicy struct {
+	// Last is the number of most recent runs to keep.
+	Last int
+	// Daily, Weekly, Monthly and Yearly are the number of most recent days,
+	// weeks, months and years for which to keep the most recent run.
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+	// Within keeps all runs that started within this duration before now.
+	Within time.Duration
+	// Tags keeps all runs that have any of these tags.
+	Tags []string
+}
+
+// Empty determines if the policy has no rules, i.e. it would not keep any run.
+func (p RetentionPolicy) Empty() bool {
+	return 0 == p.Last && 0 == p.Daily && 0 == p.Weekly && 0 == p.Monthly &&
+		0 == p.Yearly && 0 == p.Within && len(p.Tags) == 0
+}
+
+// Apply applies the policy to the given runs, and returns the runs to keep and
+// the runs to forget, both ordered from the most recent one to the oldest.
+func (p RetentionPolicy) Apply(records []RunRecord, now time.Time) ([]RunRecord, []RunRecord) {
+	sorted := append([]RunRecord{}, records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start.After(sorted[j].Start)
+	})
+
+	buckets := []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	// Track per command how many runs and periods have been kept so far.
+	type state struct {
+		last    int
+		periods []map[string]bool
+	}
+	states := make(map[string]*state)
+
+	keep, forget := []RunRecord{}, []RunRecord{}
+	for _, record := range sorted {
+		s, found := states[record.Command]
+		if !found {
+			s = &state{periods: make([]map[string]bool, len(buckets))}
+			for n := range s.periods {
+				s.periods[n] = make(map[string]bool)
+			}
+			states[record.Command] = s
+		}
+
+		kept := false
+		if s.last < p.Last {
+			s.last++
+			kept = true
+		}
+
+		start := record.Start.Local()
+		for n, bucket := range buckets {
+			period := bucket.period(start)
+			if len(s.periods[n]) < bucket.count && !s.periods[n][period] {
+				// Runs are visited from the most recent one, so this is the
+				// most recent run of the period.
+				s.periods[n][period] = true
+				kept = true
+			}
+		}
+
+		if 0 != p.Within && record.Start.After(now.Add(-p.Within)) {
+			kept = true
+		}
+		if hasAnyTag(record, p.Tags) {
+			kept = true
+		}
+
+		if kept {
+			keep = append(keep, record)
+		} else {
+			forget = append(forget, record)
+		}
+	}
+
+	return keep, forget
+}
+
+func hasAnyTag(record RunRecord, tags []string) bool {
+	for _, tag := range tags {
+		for _, recordTag := range record.Tags {
+			if tag == recordTag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,165 @@
+package archiving
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// retentionNow is the time the retention policies are applied at in the tests.
+var retentionNow = time.Date(2026, 3, 15, 12, 0, 0, 0, time.Local)
+
+func newTestRun(id, command string, start time.Time, tags ...string) RunRecord {
+	return RunRecord{
+		ID:      id,
+		Command: command,
+		Start:   start,
+		Tags:    tags,
+	}
+}
+
+func at(year int, month time.Month, day, hour int) time.Time {
+	return time.Date(year, month, day, hour, 0, 0, 0, time.Local)
+}
+
+func TestRetentionPolicyApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   RetentionPolicy
+		records  []RunRecord
+		wantKeep []string
+	}{
+		{
+			name:   "last",
+			policy: RetentionPolicy{Last: 2},
+			records: []RunRecord{
+				newTestRun("a", "backup", at(2026, 3, 12, 10)),
+				newTestRun("c", "backup", at(2026, 3, 14, 10)),
+				newTestRun("b", "backup", at(2026, 3, 13, 10)),
+			},
+			wantKeep: []string{"c", "b"},
+		},
+		{
+			name:   "daily keeps the most recent run of each day",
+			policy: RetentionPolicy{Daily: 2},
+			records: []RunRecord{
+				newTestRun("d1-early", "backup", at(2026, 3, 12, 8)),
+				newTestRun("d1-late", "backup", at(2026, 3, 12, 20)),
+				newTestRun("d2", "backup", at(2026, 3, 13, 10)),
+				newTestRun("d3-early", "backup", at(2026, 3, 14, 8)),
+				newTestRun("d3-late", "backup", at(2026, 3, 14, 20)),
+			},
+			wantKeep: []string{"d3-late", "d2"},
+		},
+		{
+			name:   "daily only counts days with runs",
+			policy: RetentionPolicy{Daily: 2},
+			records: []RunRecord{
+				newTestRun("old", "backup", at(2026, 1, 1, 10)),
+				newTestRun("older", "backup", at(2025, 12, 1, 10)),
+				newTestRun("recent", "backup", at(2026, 3, 14, 10)),
+			},
+			wantKeep: []string{"recent", "old"},
+		},
+		{
+			name:   "weekly uses ISO weeks",
+			policy: RetentionPolicy{Weekly: 2},
+			records: []RunRecord{
+				newTestRun("w9", "backup", at(2026, 2, 27, 10)),
+				newTestRun("w10", "backup", at(2026, 3, 6, 10)),
+				newTestRun("w11-mon", "backup", at(2026, 3, 9, 10)),
+				newTestRun("w11-wed", "backup", at(2026, 3, 11, 10)),
+			},
+			wantKeep: []string{"w11-wed", "w10"},
+		},
+		{
+			name:   "monthly and yearly",
+			policy: RetentionPolicy{Monthly: 1, Yearly: 2},
+			records: []RunRecord{
+				newTestRun("2024", "backup", at(2024, 6, 1, 10)),
+				newTestRun("2025-jan", "backup", at(2025, 1, 1, 10)),
+				newTestRun("2025-dec", "backup", at(2025, 12, 1, 10)),
+				newTestRun("2026-mar-1", "backup", at(2026, 3, 1, 10)),
+				newTestRun("2026-mar-2", "backup", at(2026, 3, 2, 10)),
+			},
+			wantKeep: []string{"2026-mar-2", "2025-dec"},
+		},
+		{
+			name:   "within",
+			policy: RetentionPolicy{Within: 48 * time.Hour},
+			records: []RunRecord{
+				newTestRun("1h", "backup", retentionNow.Add(-time.Hour)),
+				newTestRun("47h", "backup", retentionNow.Add(-47*time.Hour)),
+				newTestRun("49h", "backup", retentionNow.Add(-49*time.Hour)),
+			},
+			wantKeep: []string{"1h", "47h"},
+		},
+		{
+			name:   "tags",
+			policy: RetentionPolicy{Tags: []string{"monthly", "manual"}},
+			records: []RunRecord{
+				newTestRun("untagged", "backup", at(2026, 3, 14, 10)),
+				newTestRun("other", "backup", at(2026, 3, 13, 10), "nightly"),
+				newTestRun("manual", "backup", at(2026, 3, 12, 10), "nightly", "manual"),
+				newTestRun("monthly", "backup", at(2026, 3, 1, 10), "monthly"),
+			},
+			wantKeep: []string{"manual", "monthly"},
+		},
+		{
+			name:   "rules apply to each command separately",
+			policy: RetentionPolicy{Last: 1, Daily: 1},
+			records: []RunRecord{
+				newTestRun("backup-old", "backup", at(2026, 3, 12, 10)),
+				newTestRun("backup-new", "backup", at(2026, 3, 14, 10)),
+				newTestRun("restore-old", "restore", at(2026, 3, 13, 10)),
+				newTestRun("restore-new", "restore", at(2026, 3, 14, 8)),
+				newTestRun("gc", "gc", at(2026, 3, 1, 10)),
+			},
+			wantKeep: []string{"backup-new", "restore-new", "gc"},
+		},
+		{
+			name:   "a run is kept if any rule keeps it",
+			policy: RetentionPolicy{Last: 1, Tags: []string{"keep"}},
+			records: []RunRecord{
+				newTestRun("tagged", "backup", at(2026, 3, 1, 10), "keep"),
+				newTestRun("old", "backup", at(2026, 3, 12, 10)),
+				newTestRun("new", "backup", at(2026, 3, 14, 10)),
+			},
+			wantKeep: []string{"new", "tagged"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keep, forget := test.policy.Apply(test.records, retentionNow)
+
+			keepIDs := []string{}
+			for _, record := range keep {
+				keepIDs = append(keepIDs, record.ID)
+			}
+			if !reflect.DeepEqual(keepIDs, test.wantKeep) {
+				t.Errorf("kept %v, want %v", keepIDs, test.wantKeep)
+			}
+			if len(keep)+len(forget) != len(test.records) {
+				t.Errorf("kept %d and forgot %d of %d runs", len(keep), len(forget), len(test.records))
+			}
+			for n := 1; n < len(forget); n++ {
+				if forget[n].Start.After(forget[n-1].Start) {
+					t.Errorf("the runs to forget are not ordered from the most recent one")
+				}
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyEmpty(t *testing.T) {
+	if !(RetentionPolicy{}).Empty() {
+		t.Error("the policy without rules is not empty")
+	}
+	if (RetentionPolicy{Tags: []string{"keep"}}).Empty() {
+		t.Error("the policy with tags is empty")
+	}
+	if (RetentionPolicy{Within: time.Hour}).Empty() {
+		t.Error("the policy with a duration is empty")
+	}
+}
@@ -1,35 +1,80 @@
 package archiving
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
 	"github.com/golang/glog"
+	"github.com/rokeller/bart/domain"
 	"github.com/rokeller/bart/settings"
+	"google.golang.org/protobuf/proto"
 )
 
-func loadSettings(p StorageProvider) settings.Settings {
+// Exists determines if the archive exists in the backup destination, i.e. if
+// it has settings.
+func Exists(p StorageProvider) (bool, error) {
 	r, err := p.ReadSettings()
+	if err == SettingsNotFound {
+		return false, nil
+	} else if nil != err {
+		return false, err
+	}
+	r.Close()
+
+	return true, nil
+}
+
+// loadSettings loads the settings of the archive, or creates new settings if
+// the archive doesn't have settings yet, and reports whether they are new. New
+// settings are not stored until the key check is added.
+func (a *Archive) loadSettings() bool {
+	r, err := a.storageProvider.ReadSettings()
 	if nil != err {
 		if err == SettingsNotFound {
 			glog.Info("Settings not found, creating new settings.")
-			settings := settings.NewSettings()
-
-			err = storeSettings(p, settings)
-			if nil != err {
-				glog.Exitf("Settings could not be written to backup destination: %v", err)
-			}
-
-			return settings
+			a.settings = settings.NewSettings()
+			return true
 		}
 
-		glog.Exitf("Failed to load archive settings: %v", err)
+		a.exit(fmt.Sprintf("Failed to load archive settings: %v", err))
 	}
 	defer r.Close()
 
-	settings, err := settings.NewSettingsFromReader(r)
+	a.settings, err = settings.NewSettingsFromReader(r)
 	if nil != err {
-		glog.Exitf("Failed to read settings: %v", err)
+		a.exit(fmt.Sprintf("Failed to read settings: %v", err))
+	}
+
+	return false
+}
+
+// verifyKey verifies the key derived from the password with the key check of
+// the settings. New settings, and settings of archives created by earlier
+// versions, get the key check added.
+func (a *Archive) verifyKey(isNew bool) {
+	if isNew {
+		a.storeKeyCheck()
+		return
+	}
+
+	if keyCheck := a.settings.KeyCheck(); nil != keyCheck {
+		if !a.cryptoContext.VerifyKeyCheck(keyCheck) {
+			a.exit("The password is wrong for this archive.")
+		}
+		return
 	}
 
-	return settings
+	glog.V(1).Info("The archive settings don't have a key check yet.")
+}
+
+// storeKeyCheck adds the key check to the settings and stores them.
+func (a *Archive) storeKeyCheck() {
+	a.settings = a.settings.WithKeyCheck(a.cryptoContext.KeyCheck())
+	if err := storeSettings(a.storageProvider, a.settings); nil != err {
+		a.exit(fmt.Sprintf("Settings could not be written to backup destination: %v", err))
+	}
 }
 
 func storeSettings(p StorageProvider, s settings.Settings) error {
@@ -37,7 +82,90 @@ func storeSettings(p StorageProvider, s settings.Settings) error {
 	if nil != err {
 		return err
 	}
-	defer w.Close()
 
-	return s.Write(w)
+	if err := s.Write(w); nil != err {
+		Abort(w)
+		return err
+	}
+
+	return w.Close()
+}
+
+// rememberedRoots returns the named roots stored in the settings, which map the
+// names of the roots to the directories they were backed up from.
+func (a Archive) rememberedRoots() map[string]string {
+	roots := map[string]string{}
+	data := a.settings.Roots()
+	if nil == data {
+		return roots
+	}
+
+	r, err := a.cryptoContext.Decrypt(bytes.NewReader(data))
+	if nil == err {
+		data, err = io.ReadAll(r)
+	}
+	msg := &domain.Roots{}
+	if nil == err {
+		err = proto.Unmarshal(data, msg)
+	}
+	if nil != err {
+		glog.Warningf("Failed to read the roots of the archive: %v", err)
+		return roots
+	}
+
+	for _, root := range msg.Roots {
+		roots[root.GetName()] = root.GetDir()
+	}
+
+	return roots
+}
+
+// rememberRoots adds the named roots of the local context to the roots stored
+// in the settings, and stores the settings if that changes them.
+func (a *Archive) rememberRoots() {
+	roots := a.rememberedRoots()
+	changed := false
+	for name, rootDir := range a.localContext.namedRoots() {
+		if existing, found := roots[name]; !found || existing != rootDir {
+			roots[name] = rootDir
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msg := &domain.Roots{}
+	for _, name := range names {
+		msg.Roots = append(msg.Roots, &domain.Root{
+			Name: proto.String(name),
+			Dir:  proto.String(roots[name]),
+		})
+	}
+
+	data, err := proto.Marshal(msg)
+	buf := &bytes.Buffer{}
+	if nil == err {
+		var w io.WriteCloser
+		if w, err = a.cryptoContext.Encrypt(buf); nil == err {
+			_, err = w.Write(data)
+		}
+	}
+	if nil == err {
+		glog.V(1).Infof("Remembering the roots %v of the archive.", names)
+		err = storeSettings(a.storageProvider, a.settings.WithRoots(buf.Bytes()))
+	}
+	if nil != err {
+		// The roots can still be given for restore.
+		glog.Warningf("Failed to store the roots of the archive: %v", err)
+		return
+	}
+
+	a.settings = a.settings.WithRoots(buf.Bytes())
 }
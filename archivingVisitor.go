@@ -1,9 +1,9 @@
 package main
 
 import (
-	"fmt"
 	"io/fs"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
@@ -13,19 +13,27 @@ import (
 type archivingVisitor struct {
 	a      archiving.Archive
 	whatif bool
+	output *runOutput
 	wg     *sync.WaitGroup
-	queue  chan domain.Entry
+	queue  chan uploadItem
+}
+
+type uploadItem struct {
+	domain.Entry
+	size int64
 }
 
 func NewArchivingVisitor(
 	commonArgs commonArguments,
 	a archiving.Archive,
+	output *runOutput,
 ) archivingVisitor {
 	v := archivingVisitor{
 		a:      a,
 		whatif: commonArgs.whatIf,
+		output: output,
 		wg:     &sync.WaitGroup{},
-		queue:  make(chan domain.Entry, commonArgs.degreeOfParallelism*2),
+		queue:  make(chan uploadItem, commonArgs.degreeOfParallelism*2),
 	}
 
 	for i := 0; i < commonArgs.degreeOfParallelism; i++ {
@@ -59,11 +67,15 @@ func (v archivingVisitor) VisitFile(path string, f fs.DirEntry) {
 		RelPath: path,
 		EntryMetadata: domain.EntryMetadata{
 			Timestamp: info.ModTime().Unix(),
+			Size:      info.Size(),
 		},
 	}
 
+	tracker := v.output.progress.Tracker()
+	tracker.Discovered(info.Size())
 	if v.a.NeedsBackup(entry) {
-		v.queue <- entry
+		tracker.Queued(info.Size())
+		v.queue <- uploadItem{Entry: entry, size: info.Size()}
 	}
 }
 
@@ -71,25 +83,27 @@ func (v archivingVisitor) handleUploadQueue(id int) {
 	numSuccessful, numFailed := 0, 0
 
 	for {
-		entry, isOpen := <-v.queue
+		item, isOpen := <-v.queue
 		if !isOpen {
 			break
 		}
 
-		glog.V(1).Infof("[Uploader-%d] Backup file '%s' ...", id, entry.RelPath)
+		glog.V(1).Infof("[Uploader-%d] Backup file '%s' ...", id, item.RelPath)
 
 		if v.whatif {
 			numSuccessful++
-			fmt.Println(entry.RelPath)
+			v.output.FileDone("backup", item.RelPath, item.size, 0)
 			continue
 		}
 
-		if err := v.a.Backup(entry); nil != err {
+		start := time.Now()
+		if err := v.a.Backup(item.Entry); nil != err {
 			numFailed++
-			glog.Errorf("[Uploader-%d] Backup of file '%s' failed: %v", id, entry.RelPath, err)
+			v.output.FileFailed("backup", item.RelPath, item.size, time.Since(start), err)
+			glog.Errorf("[Uploader-%d] Backup of file '%s' failed: %v", id, item.RelPath, err)
 		} else {
 			numSuccessful++
-			fmt.Println(entry.RelPath)
+			v.output.FileDone("backup", item.RelPath, item.size, time.Since(start))
 		}
 	}
 
@@ -4,34 +4,37 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
-	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
 	"github.com/rokeller/bart/providers/azureBlobs"
 )
 
 var (
 	serviceURL *string
+	timeout    *time.Duration
 )
 
 func updateFlags(flags *flag.FlagSet) {
 	serviceURL = flags.String("azep", "", "The blob service endpoint URL.")
+	timeout = flags.Duration("timeout", 30*time.Second,
+		"The timeout for individual operations on the blob service.")
 }
 
 func verifyFlags() {
 	if "" == *serviceURL {
-		glog.Exit("The Azure blob service endpoint URL must not be empty.")
+		exit("The Azure blob service endpoint URL must not be empty.")
 	}
 }
 
 func newStorageProvider(backupName string) archiving.StorageProvider {
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
-		glog.Exit("Credentials for Azure could not be found: %v", err)
+		exitf("Credentials for Azure could not be found: %v", err)
 	}
 
-	provider := azureBlobs.NewAzureStorageProvider(*serviceURL, backupName, cred)
+	provider := azureBlobs.NewAzureStorageProvider(*serviceURL, backupName, cred, *timeout)
 
 	return provider
 }
@@ -4,19 +4,26 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"github.com/rokeller/bart/archiving"
 	"github.com/rokeller/bart/providers/azureBlobs"
 )
 
+var (
+	timeout *time.Duration
+)
+
 func updateFlags(flags *flag.FlagSet) {
+	timeout = flags.Duration("timeout", 30*time.Second,
+		"The timeout for individual operations on the blob service.")
 }
 
 func verifyFlags() {
 }
 
 func newStorageProvider(backupName string) archiving.StorageProvider {
-	provider := azureBlobs.NewAzuriteStorageProvider(backupName)
+	provider := azureBlobs.NewAzuriteStorageProvider(backupName, *timeout)
 
 	return provider
 }
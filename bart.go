@@ -3,35 +3,43 @@ package main
 import (
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/golang/glog"
-	"github.com/howeyc/gopass"
 )
 
+// stopping is closed when the process is interrupted, so that failed operations
+// are not retried anymore.
+var stopping = make(chan struct{})
+
 func main() {
 	cmd := parseCommand()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Kill, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	go cmd.Run()
-	defer cmd.Stop()
 
+	interrupted := false
 	select {
 	case s := <-c:
 		glog.V(0).Info("Got signal:", s)
+		interrupted = true
+		close(stopping)
+		// Stopping makes sure the archive index is uploaded one last time, so
+		// don't let more signals get in the way.
+		go func() {
+			for range c {
+				glog.Warning("Still stopping and uploading the archive index, please wait.")
+			}
+		}()
 	case <-cmd.Finished():
 		// The command has finished by itself.
 		break
 	}
-}
-
-func readPassword() string {
-	data, err := gopass.GetPasswdPrompt("Please enter your password: ", true, os.Stdin, os.Stderr)
-
-	if nil != err {
-		glog.Exitf("Failed to read password: %v", err)
-	}
 
-	return string(data)
+	cmd.Stop()
+	exitCode := cmd.Summarize(interrupted)
+	glog.Flush()
+	os.Exit(exitCode)
 }
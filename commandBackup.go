@@ -2,13 +2,22 @@ package main
 
 import (
 	"flag"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/golang/glog"
-	"github.com/rokeller/bart/inspection"
+	"github.com/rokeller/bart/domain"
 )
 
 type cmdBackup struct {
 	cmdBase
+
+	// stdin backs up stdin as the file with the relative path in as, instead
+	// of the local files.
+	stdin bool
+	as    string
 }
 
 // Finished implements Command.
@@ -20,15 +29,63 @@ func (c *cmdBackup) Finished() <-chan bool {
 func (c *cmdBackup) Run() {
 	defer c.signalFinished()
 
+	if !c.runPreHook() {
+		return
+	}
+
+	if c.stdin {
+		c.backupStdin()
+		return
+	}
+
+	c.output.progress.Start()
+
 	// Visit local files and upload the ones missing or changed.
-	visitor := NewArchivingVisitor(c.args, c.archive)
-	err := inspection.Discover(c.args.localRoot, visitor)
+	visitor := NewArchivingVisitor(c.args, c.archive, c.output)
+	err := discoverRoots(c.args, visitor)
 	if nil != err {
+		// The files discovered so far are still backed up, but the run failed.
 		glog.Errorf("Discovery failed: %v", err)
+		c.output.Fatal(err)
 	}
+	c.output.progress.Tracker().DiscoveryComplete()
 	visitor.Complete()
 }
 
+// backupStdin backs up what is piped into bart, e.g. the output of pg_dump.
+func (c *cmdBackup) backupStdin() {
+	entry := domain.Entry{
+		RelPath: c.as,
+		EntryMetadata: domain.EntryMetadata{
+			Timestamp: time.Now().Unix(),
+		},
+	}
+
+	tracker := c.output.progress.Tracker()
+	tracker.Discovered(0)
+	tracker.Queued(0)
+	tracker.DiscoveryComplete()
+
+	glog.V(1).Infof("Backup stdin as '%s' ...", c.as)
+	if c.args.whatIf {
+		c.output.FileDone("backup", c.as, 0, 0)
+		return
+	}
+
+	start := time.Now()
+	if err := c.archive.BackupStream(entry, os.Stdin); nil != err {
+		glog.Errorf("Backup of stdin as '%s' failed: %v", c.as, err)
+		c.output.FileFailed("backup", c.as, 0, time.Since(start), err)
+		return
+	}
+
+	var size int64
+	if stored := c.archive.GetEntry(c.as); nil != stored {
+		size = stored.Size
+	}
+	c.output.FileDone("backup", c.as, size, time.Since(start))
+}
+
 // Stop implements Command.
 func (c *cmdBackup) Stop() {
 	c.stop()
@@ -36,14 +93,47 @@ func (c *cmdBackup) Stop() {
 
 func newBackupCommand(args []string) Command {
 	backupFlags := flag.NewFlagSet("backup", flag.ExitOnError)
+	stdin := backupFlags.Bool("stdin", false, "Set to true to back up what is piped into bart, e.g. the output of pg_dump, instead of the local files.")
+	as := backupFlags.String("as", "", "The relative path in the archive to back up stdin as, e.g. 'db/dump.sql'.")
+	hookArgs := addHookArgs(backupFlags)
 	commonArgs := addCommonArgs(backupFlags)
 	backupFlags.Parse(args)
 
+	if *stdin {
+		*as = strings.TrimSpace(*as)
+		if "" == *as {
+			glog.Exit("The relative path to back up stdin as must be given with -as.")
+		}
+		*as = path.Clean(*as)
+		if "." == *as || "/" == *as || ".." == *as || strings.HasPrefix(*as, "../") {
+			glog.Exitf("Invalid relative path '%s' to back up stdin as.", *as)
+		}
+
+		// The password cannot be read from stdin too.
+		if !hasPasswordSource(*commonArgs) {
+			glog.Exit("Backing up stdin needs the password from -password-env, -password-file, -password-cmd or -keyfile.")
+		}
+
+		// The size of the stream is not known in advance.
+		commonArgs.progressMode = "none"
+	} else if "" != *as {
+		glog.Exit("-as can only be used with -stdin.")
+	}
+
+	output := newRunOutput("backup", *commonArgs).withHooks(*hookArgs, *commonArgs)
+	options := newArchiveOptions(*commonArgs)
+	// Restore maps the roots to their directories by default.
+	options.RememberRoots = true
+
 	return &cmdBackup{
 		cmdBase: cmdBase{
 			args:     *commonArgs,
-			archive:  newArchive(*commonArgs),
+			archive:  newArchiveWithOptions(*commonArgs, options, true),
+			output:   output,
 			finished: make(chan bool),
 		},
+
+		stdin: *stdin,
+		as:    *as,
 	}
 }
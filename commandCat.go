@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/domain"
+)
+
+// cmdCat writes the content of a file in the archive to stdout, or to a local
+// file for 'get', without restoring it.
+type cmdCat struct {
+	cmdBase
+
+	relPath string
+	// outPath is the local file to write to for 'get'; empty for stdout.
+	outPath string
+	force   bool
+}
+
+// Finished implements Command.
+func (c *cmdCat) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdCat) Run() {
+	defer c.signalFinished()
+
+	entry := c.archive.GetEntry(c.relPath)
+	if nil == entry {
+		err := fmt.Errorf("the file '%s' was not found in the backup", c.relPath)
+		glog.Error(err)
+		c.output.Fatal(err)
+		return
+	}
+
+	tracker := c.output.progress.Tracker()
+	tracker.Discovered(entry.Size)
+	tracker.Queued(entry.Size)
+	tracker.DiscoveryComplete()
+
+	start := time.Now()
+	if "" != c.outPath {
+		if err := c.get(*entry); nil != err {
+			glog.Errorf("Failed to get file '%s' from the backup: %v", c.relPath, err)
+			c.output.FileFailed("get", c.relPath, entry.Size, time.Since(start), err)
+		} else {
+			c.output.FileDoneTo("get", c.relPath, c.outPath, entry.Size, time.Since(start))
+		}
+		return
+	}
+
+	// The file's content is the only thing written to stdout.
+	if err := c.archive.Extract(*entry, os.Stdout); nil != err {
+		glog.Errorf("Failed to read file '%s' from the backup: %v", c.relPath, err)
+		c.output.FileFailed("cat", c.relPath, entry.Size, time.Since(start), err)
+	} else {
+		tracker.Done(entry.Size)
+	}
+}
+
+// get writes the given entry to the output file. The content is written to a
+// temporary file first, so that a failure doesn't leave a partial file behind.
+func (c *cmdCat) get(entry domain.Entry) error {
+	if _, err := os.Stat(c.outPath); nil == err && !c.force {
+		return fmt.Errorf("the file '%s' already exists; use -force to overwrite it", c.outPath)
+	}
+
+	tmp, err := createTemp(filepath.Dir(c.outPath))
+	if nil != err {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := c.archive.Extract(entry, tmp); nil != err {
+		return err
+	}
+	if err := tmp.Close(); nil != err {
+		return err
+	}
+
+	ts := time.Unix(entry.Timestamp, 0)
+	if err := os.Chtimes(tmp.Name(), ts, ts); nil != err {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.outPath)
+}
+
+// createTemp creates a new temporary file in the given directory, like
+// os.CreateTemp, but with the permissions of os.Create, since it is renamed to
+// the file to write.
+func createTemp(dir string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		name := filepath.Join(dir, ".bart-get-"+strconv.FormatUint(uint64(rand.Uint32()), 10))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !errors.Is(err, os.ErrExist) || attempt >= 1000 {
+			return f, err
+		}
+	}
+}
+
+// Stop implements Command.
+func (c *cmdCat) Stop() {
+	c.stop()
+}
+
+func newCatCommand(args []string) Command {
+	catFlags := flag.NewFlagSet("cat", flag.ExitOnError)
+	commonArgs := addCommonArgs(catFlags)
+	relPath := parseRelPathArg(catFlags, args)
+
+	// Keep stdout for the file's content.
+	commonArgs.progressMode = "none"
+	commonArgs.outputFormat = "text"
+
+	output := newRunOutput("cat", *commonArgs)
+
+	return &cmdCat{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchive(*commonArgs, false),
+			output:   output,
+			finished: make(chan bool),
+			readOnly: true,
+		},
+
+		relPath: relPath,
+	}
+}
+
+func newGetCommand(args []string) Command {
+	getFlags := flag.NewFlagSet("get", flag.ExitOnError)
+	outPath := getFlags.String("o", "", "The local file or directory to write to; defaults to the file's name in the current directory.")
+	force := getFlags.Bool("force", false, "Set to true to overwrite an existing local file.")
+	commonArgs := addCommonArgs(getFlags)
+	relPath := parseRelPathArg(getFlags, args)
+
+	if "" == *outPath {
+		*outPath = path.Base(relPath)
+	} else if info, err := os.Stat(*outPath); nil == err && info.IsDir() {
+		*outPath = filepath.Join(*outPath, path.Base(relPath))
+	}
+
+	// There is no point in reporting progress for a single file.
+	commonArgs.progressMode = "none"
+
+	return &cmdCat{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchive(*commonArgs, false),
+			output:   newRunOutput("get", *commonArgs),
+			finished: make(chan bool),
+			readOnly: true,
+		},
+
+		relPath: relPath,
+		outPath: *outPath,
+		force:   *force,
+	}
+}
+
+// parseRelPathArg parses the arguments of a command taking the relative path
+// of a single file in the archive. Flags may follow the relative path too.
+func parseRelPathArg(flagset *flag.FlagSet, args []string) string {
+	flagset.Parse(args)
+
+	relPath := flagset.Arg(0)
+	if flagset.NArg() > 0 {
+		flagset.Parse(flagset.Args()[1:])
+	}
+	if "" == relPath || flagset.NArg() > 0 {
+		glog.Exitf("Expected the relative path of exactly one file for '%s'.", flagset.Name())
+	}
+
+	return relPath
+}
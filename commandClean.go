@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/domain"
-	"github.com/rokeller/bart/inspection"
+	"github.com/rokeller/bart/progress"
 )
 
 type CleanupLocation int
@@ -25,12 +32,37 @@ type cmdCleanup struct {
 	cmdBase
 
 	location CleanupLocation
-	wg       *sync.WaitGroup
-	queue    chan deleteMessage
+	// maxDeletePercent is the percentage of the archive that may be moved to
+	// the trash without force.
+	maxDeletePercent int
+	force            bool
+	// trashGrace is how long files stay in the trash before they are deleted.
+	trashGrace time.Duration
+	// minCoverage is the percentage of the local files that must be in the
+	// backup to delete the others without force.
+	minCoverage int
+	// yes skips the confirmation before deleting local files.
+	yes bool
+	// quarantineDir is where local files are moved to instead of deleting
+	// them; empty to delete them.
+	quarantineDir string
+	// roots maps the names of the roots to clean up to their local
+	// directories.
+	roots map[string]string
+	// dirs collects the directories of removed local files, to remove them
+	// too once they are empty.
+	dirs *sync.Map
+
+	wg    *sync.WaitGroup
+	queue chan deleteMessage
 }
 
 type deleteMessage interface{}
 
+type trashInBackup struct {
+	domain.Entry
+}
+
 type deleteFromBackup struct {
 	domain.Entry
 }
@@ -38,6 +70,7 @@ type deleteFromBackup struct {
 type deleteFromLocal struct {
 	relPath      string
 	absolutePath string
+	size         int64
 }
 
 // Finished implements Command.
@@ -49,6 +82,15 @@ func (c *cmdCleanup) Finished() <-chan bool {
 func (c *cmdCleanup) Run() {
 	defer c.signalFinished()
 
+	if !c.runPreHook() {
+		return
+	}
+
+	// Progress for cleaning up locally starts after the confirmation.
+	if CleanupLocationLocal != c.location {
+		c.output.progress.Start()
+	}
+
 	for i := 0; i < c.args.degreeOfParallelism; i++ {
 		c.wg.Add(1)
 		go func(id int) {
@@ -66,6 +108,7 @@ func (c *cmdCleanup) Run() {
 	default:
 		glog.Fatalf("Unhandled cleanup location %d.", c.location)
 	}
+	c.output.progress.Tracker().DiscoveryComplete()
 }
 
 // Stop implements Command.
@@ -73,6 +116,7 @@ func (c *cmdCleanup) Stop() {
 	close(c.queue)
 	c.wg.Wait()
 
+	c.removeEmptyDirs()
 	c.stop()
 }
 
@@ -83,6 +127,13 @@ func newCleanupCommand(args []string) Command {
 		"The location to clean up: 'backup' to remove files missing locally "+
 			"from the backup, 'local' to remove files missing in the backup "+
 			"from the local file system.")
+	maxDeletePercent := cleanFlags.Int("max-delete", 25, "The maximum percentage of the files in the backup to move to the trash without -force.")
+	force := cleanFlags.Bool("force", false, "Set to true to skip the checks guarding against cleaning up too many files, e.g. because of a wrong -path.")
+	trashGrace := cleanFlags.Duration("trash-grace", 30*24*time.Hour, "How long files stay in the trash before they are deleted from the backup.")
+	minCoverage := cleanFlags.Int("min-coverage", 50, "The minimum percentage of the local files that must be in the backup to remove the others locally without -force.")
+	yes := cleanFlags.Bool("yes", false, "Set to true to remove local files without asking for confirmation on the terminal, e.g. in scripts.")
+	quarantineDir := cleanFlags.String("quarantine", "", "The directory to move local files to instead of deleting them; must be outside of -path. Files are copied when it is on another file system.")
+	hookArgs := addHookArgs(cleanFlags)
 	commonArgs := addCommonArgs(cleanFlags)
 	cleanFlags.Parse(args)
 
@@ -97,51 +148,304 @@ func newCleanupCommand(args []string) Command {
 		glog.Exit("The cleanup location must either be 'backup' or 'local'.")
 	}
 
+	if "" != *quarantineDir {
+		*quarantineDir = newQuarantineDir(*quarantineDir, localRoots(*commonArgs))
+	}
+
+	output := newRunOutput("cleanup", *commonArgs).withHooks(*hookArgs, *commonArgs)
+
 	return &cmdCleanup{
 		cmdBase: cmdBase{
 			args:     *commonArgs,
-			archive:  newArchive(*commonArgs),
+			archive:  newArchive(*commonArgs, location == CleanupLocationBackup),
+			output:   output,
 			finished: make(chan bool),
 		},
 
-		location: location,
-		wg:       &sync.WaitGroup{},
-		queue:    make(chan deleteMessage, commonArgs.degreeOfParallelism*2),
+		location:         location,
+		maxDeletePercent: *maxDeletePercent,
+		force:            *force,
+		trashGrace:       *trashGrace,
+		minCoverage:      *minCoverage,
+		yes:              *yes,
+		quarantineDir:    *quarantineDir,
+		roots:            localRoots(*commonArgs),
+		dirs:             &sync.Map{},
+
+		wg:    &sync.WaitGroup{},
+		queue: make(chan deleteMessage, commonArgs.degreeOfParallelism*2),
 	}
 }
 
 func (c *cmdCleanup) cleanupBackup() {
 	// Find files that are in the backup index, but cannot be found locally and
-	// queue their backup copy for deletion.
+	// queue them to be moved to the trash.
+	tracker := c.output.progress.Tracker()
+	numEntries := 0
+	missing := []domain.Entry{}
+	c.archive.WalkBackup(func(entry domain.Entry) {
+		if _, found := c.archive.AbsPath(entry.RelPath); found {
+			numEntries++
+		}
+	})
 	c.archive.FindLocallyMissing(func(entry domain.Entry) {
-		// The item is present in the backup, but not locally.
-		absLocalPath := path.Join(c.args.localRoot, entry.RelPath)
+		// The item is present in the backup, but not locally. Files of roots
+		// that were not given are kept.
+		absLocalPath, found := c.archive.AbsPath(entry.RelPath)
+		if !found {
+			return
+		}
 		if glog.V(3) {
 			glog.Infof("Checking local file '%s' ...", absLocalPath)
 		}
 
 		_, err := os.Stat(absLocalPath)
 		if errors.Is(err, os.ErrNotExist) {
-			if glog.V(3) {
-				glog.Infof("Local file '%s' not found. Queue deletion of '%s' from backup",
-					absLocalPath, entry.RelPath)
-			}
-			c.queue <- deleteFromBackup{Entry: entry}
+			missing = append(missing, entry)
 		} else if nil != err {
 			glog.Errorf("Failed to check for local file '%s': %v",
 				entry.RelPath, err)
 		}
 	})
+
+	// Running against the wrong path would move everything to the trash.
+	if !c.force && len(missing)*100 > c.maxDeletePercent*numEntries {
+		err := fmt.Errorf("%d of %d file(s) in the backup are missing locally, which exceeds %d%%; use -force to move them to the trash anyway",
+			len(missing), numEntries, c.maxDeletePercent)
+		glog.Error(err)
+		c.output.Fatal(err)
+		// The run was refused, so the expired trash is kept as well.
+		return
+	}
+
+	for _, entry := range missing {
+		if glog.V(3) {
+			glog.Infof("Local file '%s' not found. Queue moving '%s' to the trash",
+				entry.RelPath, entry.RelPath)
+		}
+		tracker.Discovered(entry.StoredSize)
+		tracker.Queued(entry.StoredSize)
+		c.queue <- trashInBackup{Entry: entry}
+	}
+
+	// Delete the files that have been in the trash for long enough.
+	cutoff := time.Now().Add(-c.trashGrace).Unix()
+	c.archive.WalkTrash(func(entry domain.Entry) {
+		if entry.TrashTime < cutoff {
+			tracker.Discovered(entry.StoredSize)
+			tracker.Queued(entry.StoredSize)
+			c.queue <- deleteFromBackup{Entry: entry}
+		}
+	})
 }
 
 func (c *cmdCleanup) cleanupLocal() {
 	// Find local files that are not in the backup and queue them for deletion
-	// from the local file system.
-
-	v := NewDeletingVisitor(c.archive, c.args.localRoot, c.queue)
-	err := inspection.Discover(c.args.localRoot, v)
+	// from the local file system, once they have been checked.
+	tracker := c.output.progress.Tracker()
+	v := NewDeletingVisitor(c.archive, tracker)
+	err := discoverRoots(c.args, v)
 	if nil != err {
 		glog.Errorf("Discovery failed: %v", err)
+		c.output.Fatal(err)
+		return
+	}
+
+	candidates := v.Candidates()
+	if err := c.checkLocalCleanup(v.NumFiles(), candidates); nil != err {
+		glog.Error(err)
+		c.output.Fatal(err)
+		return
+	}
+
+	c.output.progress.Start()
+	for _, candidate := range candidates {
+		tracker.Queued(candidate.size)
+		c.queue <- candidate
+	}
+}
+
+// checkLocalCleanup guards against deleting the user's data, e.g. when cleaning
+// up before the first backup or against the wrong archive, and asks for
+// confirmation.
+func (c *cmdCleanup) checkLocalCleanup(numFiles int, candidates []deleteFromLocal) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	var size int64
+	for _, candidate := range candidates {
+		size += candidate.size
+	}
+
+	if !c.force {
+		numEntries := 0
+		c.archive.WalkBackup(func(entry domain.Entry) {
+			numEntries++
+		})
+		if 0 == numEntries {
+			return errors.New("the archive index is empty, so all local files would be removed; use -force to remove them anyway")
+		}
+
+		coverage := (numFiles - len(candidates)) * 100 / numFiles
+		if coverage < c.minCoverage {
+			return fmt.Errorf("only %d%% of the local files are in the backup, which is below %d%%; use -force to remove the others anyway",
+				coverage, c.minCoverage)
+		}
+	}
+
+	if c.args.whatIf || c.yes {
+		return nil
+	}
+
+	verb := "delete"
+	if "" != c.quarantineDir {
+		verb = "move to '" + c.quarantineDir + "'"
+	}
+	fmt.Fprintf(os.Stderr, "\nAbout to %s %d of %d local file(s) (%s) missing in the backup. Continue? [y/N] ",
+		verb, len(candidates), numFiles, progress.FormatBytes(size))
+
+	// Stdin may hold the piped password, so the answer is read from the
+	// terminal.
+	tty, err := openTerminal()
+	if nil != err {
+		return fmt.Errorf("cannot ask for confirmation without a terminal (%v); use -yes to remove the files anyway", err)
+	}
+	defer tty.Close()
+
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+
+	default:
+		return errors.New("the removal of local files was not confirmed")
+	}
+}
+
+// openTerminal opens the terminal of the process for reading.
+func openTerminal() (*os.File, error) {
+	if "windows" == runtime.GOOS {
+		return os.Open("CONIN$")
+	}
+
+	return os.Open("/dev/tty")
+}
+
+// newQuarantineDir determines the directory to move local files to for this
+// run, below the given quarantine directory.
+func newQuarantineDir(quarantineDir string, roots map[string]string) string {
+	absQuarantine, err := filepath.Abs(quarantineDir)
+	if nil != err {
+		glog.Exitf("Invalid quarantine directory: %v", err)
+	}
+
+	for _, rootDir := range roots {
+		if rootDir == absQuarantine || isBelow(rootDir, absQuarantine) {
+			glog.Exit("The quarantine directory must be outside of the paths to clean up.")
+		}
+	}
+
+	// Keep the files of different runs apart.
+	return filepath.Join(absQuarantine, time.Now().Format("20060102-150405"))
+}
+
+// removeLocal removes a local file, either by moving it to the quarantine
+// directory or by deleting it.
+func (c *cmdCleanup) removeLocal(m deleteFromLocal) error {
+	if "" == c.quarantineDir {
+		return os.Remove(m.absolutePath)
+	}
+
+	target := filepath.Join(c.quarantineDir, m.relPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); nil != err {
+		return err
+	}
+
+	err := os.Rename(m.absolutePath, target)
+	if errors.Is(err, syscall.EXDEV) {
+		// The quarantine directory is on another file system.
+		return moveAcrossDevices(m.absolutePath, target)
+	}
+
+	return err
+}
+
+// moveAcrossDevices moves a file to another file system by copying it, keeping
+// its permissions and modification time, and removing the original.
+func moveAcrossDevices(source, target string) error {
+	info, err := os.Stat(source)
+	if nil != err {
+		return err
+	}
+
+	src, err := os.Open(source)
+	if nil != err {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if nil != err {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Chtimes(target, info.ModTime(), info.ModTime())
+	}
+	if nil != err {
+		// Keep the original rather than a partial copy.
+		os.Remove(target)
+		return err
+	}
+
+	src.Close()
+	return os.Remove(source)
+}
+
+// isBelow determines if the given path is below (but not at) the given root.
+func isBelow(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return nil == err && "." != rel && !strings.HasPrefix(rel, "..")
+}
+
+// isBelowRoot determines if the given path is below (but not at) one of the
+// roots to clean up.
+func (c *cmdCleanup) isBelowRoot(p string) bool {
+	for _, rootDir := range c.roots {
+		if isBelow(rootDir, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeEmptyDirs removes the directories of removed local files, and their
+// parents, while they are empty.
+func (c *cmdCleanup) removeEmptyDirs() {
+	dirs := []string{}
+	c.dirs.Range(func(key, value any) bool {
+		dirs = append(dirs, key.(string))
+		return true
+	})
+	// Remove nested directories first.
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+
+	for _, dir := range dirs {
+		for ; c.isBelowRoot(dir); dir = path.Dir(dir) {
+			// Removing a directory fails unless it is empty.
+			if err := os.Remove(dir); nil != err {
+				break
+			}
+			glog.V(1).Infof("Removed empty directory '%s'.", dir)
+		}
 	}
 }
 
@@ -155,6 +459,17 @@ func (c *cmdCleanup) handleCleanupQueue(id int) {
 		}
 
 		switch m := msg.(type) {
+		case trashInBackup:
+			// Keep the backup file, so the file can be restored from the trash.
+			glog.V(1).Infof("[Cleanup-%d] Move file '%s' to the trash ...",
+				id, m.Entry.RelPath)
+
+			if !c.args.whatIf {
+				c.archive.Trash(m.Entry)
+			}
+			numSuccessful++
+			c.output.FileDone("trash", m.Entry.RelPath, m.StoredSize, 0)
+
 		case deleteFromBackup:
 			// Remove the entry from the backup, and from the backup index.
 			glog.V(1).Infof("[Cleanup-%d] Remove file '%s' from backup ...",
@@ -162,17 +477,21 @@ func (c *cmdCleanup) handleCleanupQueue(id int) {
 
 			if c.args.whatIf {
 				numSuccessful++
-				fmt.Println(m.Entry.RelPath)
+				c.output.FileDone("delete-from-backup", m.Entry.RelPath, m.StoredSize, 0)
 				continue
 			}
 
+			start := time.Now()
 			if err := c.archive.Delete(m.Entry); nil != err {
 				numFailed++
+				c.output.FileFailed("delete-from-backup", m.Entry.RelPath, m.StoredSize,
+					time.Since(start), err)
 				glog.Errorf("[Cleanup-%d] Removal of file '%s' failed: %v",
 					id, m.Entry.RelPath, err)
 			} else {
 				numSuccessful++
-				fmt.Println(m.Entry.RelPath)
+				c.output.FileDone("delete-from-backup", m.Entry.RelPath, m.StoredSize,
+					time.Since(start))
 			}
 
 		case deleteFromLocal:
@@ -180,19 +499,29 @@ func (c *cmdCleanup) handleCleanupQueue(id int) {
 			glog.V(1).Infof("[Cleanup-%d] Remove local file '%s' ...",
 				id, m.relPath)
 
+			action := "delete-local"
+			if "" != c.quarantineDir {
+				action = "quarantine-local"
+			}
+
 			if c.args.whatIf {
 				numSuccessful++
-				fmt.Println(m.relPath)
+				c.output.FileDone(action, m.relPath, m.size, 0)
 				continue
 			}
 
-			if err := os.Remove(m.absolutePath); nil != err {
+			start := time.Now()
+			if err := c.removeLocal(m); nil != err {
 				numFailed++
+				c.output.FileFailed(action, m.relPath, m.size,
+					time.Since(start), err)
 				glog.Errorf("[Cleanup-%d] Removal of local file '%s' failed: %v",
 					id, m.relPath, err)
 			} else {
 				numSuccessful++
-				fmt.Println(m.relPath)
+				c.dirs.Store(path.Dir(m.absolutePath), true)
+				c.output.FileDone(action, m.relPath, m.size,
+					time.Since(start))
 			}
 
 		default:
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+// cmdForget removes runs from the archive's history according to a retention
+// policy, and optionally deletes the backup files no longer referenced.
+type cmdForget struct {
+	cmdBase
+
+	policy archiving.RetentionPolicy
+	// prune deletes the unreferenced backup files after forgetting runs; nil
+	// if not asked to.
+	prune *cmdGC
+}
+
+// Finished implements Command.
+func (c *cmdForget) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdForget) Run() {
+	defer c.signalFinished()
+
+	records, err := c.archive.ListRunRecords()
+	if nil != err {
+		glog.Errorf("Failed to list runs: %v", err)
+		c.output.Fatal(err)
+		return
+	}
+
+	keep, forget := c.policy.Apply(records, time.Now())
+	glog.Infof("Keeping %d run(s), forgetting %d run(s).", len(keep), len(forget))
+
+	for _, record := range forget {
+		if c.args.whatIf {
+			c.output.RunForgotten(record.ID, nil)
+			continue
+		}
+
+		err := c.archive.DeleteRunRecord(record.ID)
+		if nil != err {
+			glog.Errorf("Failed to forget run '%s': %v", record.ID, err)
+		}
+		c.output.RunForgotten(record.ID, err)
+	}
+
+	if nil != c.prune {
+		c.prune.collect()
+	}
+}
+
+// Stop implements Command.
+func (c *cmdForget) Stop() {
+	if nil != c.prune {
+		c.prune.Stop()
+		return
+	}
+
+	c.stop()
+}
+
+func newForgetCommand(args []string) Command {
+	forgetFlags := flag.NewFlagSet("forget", flag.ExitOnError)
+	policy := archiving.RetentionPolicy{}
+	forgetFlags.IntVar(&policy.Last, "keep-last", 0, "The number of most recent runs to keep.")
+	forgetFlags.IntVar(&policy.Daily, "keep-daily", 0, "The number of most recent days for which to keep the most recent run.")
+	forgetFlags.IntVar(&policy.Weekly, "keep-weekly", 0, "The number of most recent weeks for which to keep the most recent run.")
+	forgetFlags.IntVar(&policy.Monthly, "keep-monthly", 0, "The number of most recent months for which to keep the most recent run.")
+	forgetFlags.IntVar(&policy.Yearly, "keep-yearly", 0, "The number of most recent years for which to keep the most recent run.")
+	forgetFlags.DurationVar(&policy.Within, "keep-within", 0, "Keep all runs that started within this duration, e.g. '720h'.")
+	keepTags := forgetFlags.String("keep-tags", "", "Comma-separated tags; keep all runs that have any of them.")
+	prune := forgetFlags.Bool("prune", false, "Set to true to delete backup files no longer referenced after forgetting runs, like 'gc'.")
+	gracePeriod := forgetFlags.Duration("grace", 24*time.Hour, "With -prune, only delete unreferenced backup files older than this.")
+	commonArgs := addCommonArgs(forgetFlags)
+	forgetFlags.Parse(args)
+
+	policy.Tags = parseTags(*keepTags)
+	if policy.Empty() {
+		glog.Exit("At least one -keep-* rule is needed, or all runs would be forgotten.")
+	}
+
+	if !*prune {
+		// There is no point in reporting progress for forgetting runs only.
+		commonArgs.progressMode = "none"
+	}
+
+	output := newRunOutput("forget", *commonArgs)
+
+	base := cmdBase{
+		args:     *commonArgs,
+		archive:  newArchive(*commonArgs, true),
+		output:   output,
+		finished: make(chan bool),
+	}
+
+	cmd := &cmdForget{
+		cmdBase: base,
+		policy:  policy,
+	}
+	if *prune {
+		cmd.prune = newGC(base, *gracePeriod, false)
+	}
+
+	return cmd
+}
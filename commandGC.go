@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/domain"
+)
+
+type cmdGC struct {
+	cmdBase
+
+	gracePeriod   time.Duration
+	removeMissing bool
+
+	wg    *sync.WaitGroup
+	queue chan archiving.BackupFileInfo
+}
+
+// Finished implements Command.
+func (c *cmdGC) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdGC) Run() {
+	defer c.signalFinished()
+
+	c.collect()
+}
+
+// collect deletes the backup files not referenced by the index, and reports
+// the files in the index whose backup file is missing.
+func (c *cmdGC) collect() {
+	c.output.progress.Start()
+	tracker := c.output.progress.Tracker()
+
+	for i := 0; i < c.args.degreeOfParallelism; i++ {
+		c.wg.Add(1)
+		go func(id int) {
+			defer c.wg.Done()
+			c.handleDeleteQueue(id)
+		}(i)
+	}
+
+	// Track the backup files referenced by the index, including the trash;
+	// those not seen while listing the backup files are missing.
+	referenced := make(map[string]domain.Entry)
+	reference := func(entry domain.Entry) {
+		referenced[archiving.BlobID(entry)] = entry
+	}
+	c.archive.WalkBackup(reference)
+	c.archive.WalkTrash(reference)
+
+	// Backup files are uploaded before the index references them, so recent
+	// backup files may still be referenced by a checkpoint to come.
+	cutoff := time.Now().Add(-c.gracePeriod)
+	numRecent := 0
+	err := c.archive.ListBackupFiles(func(info archiving.BackupFileInfo) error {
+		tracker.Discovered(info.Size)
+		if _, found := referenced[info.BlobID]; found {
+			delete(referenced, info.BlobID)
+		} else if info.Modified.After(cutoff) {
+			numRecent++
+		} else {
+			tracker.Queued(info.Size)
+			c.queue <- info
+		}
+
+		return nil
+	})
+	tracker.DiscoveryComplete()
+
+	if nil != err {
+		glog.Errorf("Failed to list backup files: %v", err)
+		c.output.Fatal(err)
+		return
+	}
+
+	if numRecent > 0 {
+		glog.Infof("Kept %d unreferenced backup file(s) younger than %v.", numRecent, c.gracePeriod)
+	}
+
+	c.reportMissing(referenced)
+}
+
+// Stop implements Command.
+func (c *cmdGC) Stop() {
+	close(c.queue)
+	c.wg.Wait()
+
+	c.stop()
+}
+
+func newGCCommand(args []string) Command {
+	gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+	gracePeriod := gcFlags.Duration("grace", 24*time.Hour, "Only delete unreferenced backup files older than this.")
+	removeMissing := gcFlags.Bool("remove-missing", false, "Set to true to remove files whose backup file is missing from the index, so they are backed up again.")
+	commonArgs := addCommonArgs(gcFlags)
+	gcFlags.Parse(args)
+
+	output := newRunOutput("gc", *commonArgs)
+
+	return newGC(cmdBase{
+		args:     *commonArgs,
+		archive:  newArchive(*commonArgs, true),
+		output:   output,
+		finished: make(chan bool),
+	}, *gracePeriod, *removeMissing)
+}
+
+// newGC creates a gc command for the given archive, which is also used by other
+// commands to delete unreferenced backup files.
+func newGC(base cmdBase, gracePeriod time.Duration, removeMissing bool) *cmdGC {
+	return &cmdGC{
+		cmdBase: base,
+
+		gracePeriod:   gracePeriod,
+		removeMissing: removeMissing,
+
+		wg:    &sync.WaitGroup{},
+		queue: make(chan archiving.BackupFileInfo, base.args.degreeOfParallelism*2),
+	}
+}
+
+func (c *cmdGC) handleDeleteQueue(id int) {
+	numSuccessful, numFailed := 0, 0
+
+	for {
+		info, isOpen := <-c.queue
+		if !isOpen {
+			break
+		}
+
+		glog.V(1).Infof("[GC-%d] Delete unreferenced backup file '%s' ...", id, info.BlobID)
+
+		if c.args.whatIf {
+			numSuccessful++
+			c.output.FileDone("delete-unreferenced", info.BlobID, info.Size, 0)
+			continue
+		}
+
+		start := time.Now()
+		if err := c.archive.DeleteBackupFileByID(info.BlobID); nil != err {
+			numFailed++
+			c.output.FileFailed("delete-unreferenced", info.BlobID, info.Size, time.Since(start), err)
+			glog.Errorf("[GC-%d] Deletion of backup file '%s' failed: %v", id, info.BlobID, err)
+		} else {
+			numSuccessful++
+			c.output.FileDone("delete-unreferenced", info.BlobID, info.Size, time.Since(start))
+		}
+	}
+
+	glog.Infof("[GC-%d] Finished. Successfully deleted %d backup file(s), failed to delete %d backup file(s).",
+		id, numSuccessful, numFailed)
+}
+
+// reportMissing reports the files whose backup file is missing, and removes
+// them from the index if asked to.
+func (c *cmdGC) reportMissing(missing map[string]domain.Entry) {
+	entries := make([]domain.Entry, 0, len(missing))
+	for _, entry := range missing {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RelPath < entries[j].RelPath
+	})
+
+	for _, entry := range entries {
+		glog.Warningf("The backup file of '%s' is missing.", entry.RelPath)
+		c.output.FileFailed("missing", entry.RelPath, entry.StoredSize, 0,
+			archiving.BackupFileNotFound)
+
+		if c.removeMissing && !c.args.whatIf {
+			c.archive.Forget(entry)
+		}
+	}
+}
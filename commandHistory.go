@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/progress"
+)
+
+type cmdHistory struct {
+	cmdBase
+
+	id   string
+	last int
+}
+
+type runRecordEvent struct {
+	Event           string    `json:"event"`
+	ID              string    `json:"id"`
+	Command         string    `json:"command"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	Host            string    `json:"host"`
+	Status          string    `json:"status"`
+	WhatIf          bool      `json:"whatIf"`
+	DiscoveredFiles int64     `json:"discoveredFiles"`
+	DoneFiles       int64     `json:"doneFiles"`
+	DoneBytes       int64     `json:"doneBytes"`
+	FailedFiles     int64     `json:"failedFiles"`
+	FailedBytes     int64     `json:"failedBytes"`
+	Errors          []string  `json:"errors,omitempty"`
+	Tags            []string  `json:"tags,omitempty"`
+}
+
+// Finished implements Command.
+func (c *cmdHistory) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdHistory) Run() {
+	defer c.signalFinished()
+
+	if "" != c.id {
+		c.showRun()
+	} else {
+		c.listRuns()
+	}
+}
+
+// Stop implements Command.
+func (c *cmdHistory) Stop() {
+	c.stop()
+}
+
+func newHistoryCommand(args []string) Command {
+	historyFlags := flag.NewFlagSet("history", flag.ExitOnError)
+	id := historyFlags.String("id", "", "The ID of a run to show the details of.")
+	last := historyFlags.Int("last", 0, "The number of most recent runs to list; all runs are listed when 0.")
+	commonArgs := addCommonArgs(historyFlags)
+	historyFlags.Parse(args)
+
+	if "" != *id && !archiving.ValidRunRecordID(*id) {
+		glog.Exitf("Invalid run ID '%s'; use one of the IDs listed by 'bart history'.", *id)
+	}
+
+	// There is no point in reporting progress for listing the history.
+	commonArgs.progressMode = "none"
+
+	output := newRunOutput("history", *commonArgs)
+
+	return &cmdHistory{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchive(*commonArgs, false),
+			output:   output,
+			finished: make(chan bool),
+			readOnly: true,
+		},
+
+		id:   *id,
+		last: *last,
+	}
+}
+
+func (c *cmdHistory) listRuns() {
+	records, err := c.archive.ListRunRecords()
+	if nil != err {
+		glog.Errorf("Failed to list runs: %v", err)
+		c.output.Fatal(err)
+		return
+	}
+
+	if c.last > 0 && len(records) > c.last {
+		records = records[len(records)-c.last:]
+	}
+
+	for _, record := range records {
+		duration := record.End.Sub(record.Start).Round(time.Second)
+		text := fmt.Sprintf("%s  %-8s %-11s %s  %8v  %6d done  %4d failed  %10s  %s",
+			record.ID, record.Command, statusText(record), record.Start.Format(time.DateTime),
+			duration, record.DoneFiles, record.FailedFiles,
+			progress.FormatBytes(record.DoneBytes), record.Host)
+		if len(record.Tags) > 0 {
+			text += "  [" + strings.Join(record.Tags, ",") + "]"
+		}
+		event := newRunRecordEvent(record)
+		event.Errors = nil
+
+		c.output.print(text, event)
+	}
+}
+
+func (c *cmdHistory) showRun() {
+	record, err := c.archive.GetRunRecord(c.id)
+	if nil != err {
+		glog.Errorf("Failed to read run '%s': %v", c.id, err)
+		c.output.Fatal(err)
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "ID:         %s\n", record.ID)
+	fmt.Fprintf(&sb, "Command:    %s\n", record.Command)
+	fmt.Fprintf(&sb, "Status:     %s\n", statusText(record))
+	fmt.Fprintf(&sb, "Host:       %s\n", record.Host)
+	if len(record.Tags) > 0 {
+		fmt.Fprintf(&sb, "Tags:       %s\n", strings.Join(record.Tags, ", "))
+	}
+	fmt.Fprintf(&sb, "Start:      %s\n", record.Start.Format(time.DateTime))
+	fmt.Fprintf(&sb, "End:        %s\n", record.End.Format(time.DateTime))
+	fmt.Fprintf(&sb, "Discovered: %d file(s)\n", record.DiscoveredFiles)
+	fmt.Fprintf(&sb, "Done:       %d file(s), %s\n", record.DoneFiles,
+		progress.FormatBytes(record.DoneBytes))
+	fmt.Fprintf(&sb, "Failed:     %d file(s), %s", record.FailedFiles,
+		progress.FormatBytes(record.FailedBytes))
+	for _, e := range record.Errors {
+		fmt.Fprintf(&sb, "\n  %s", e)
+	}
+
+	c.output.print(sb.String(), newRunRecordEvent(record))
+}
+
+func statusText(record archiving.RunRecord) string {
+	if record.WhatIf {
+		return record.Status + "*"
+	}
+
+	return record.Status
+}
+
+func newRunRecordEvent(record archiving.RunRecord) runRecordEvent {
+	return runRecordEvent{
+		Event:           "run",
+		ID:              record.ID,
+		Command:         record.Command,
+		Start:           record.Start,
+		End:             record.End,
+		Host:            record.Host,
+		Status:          record.Status,
+		WhatIf:          record.WhatIf,
+		DiscoveredFiles: record.DiscoveredFiles,
+		DoneFiles:       record.DoneFiles,
+		DoneBytes:       record.DoneBytes,
+		FailedFiles:     record.FailedFiles,
+		FailedBytes:     record.FailedBytes,
+		Errors:          record.Errors,
+		Tags:            record.Tags,
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+const expectedIndexCommands = "Expected index command 'rebuild'."
+
+// cmdIndexRebuild rebuilds the index of an archive from the headers of its
+// backup files, e.g. after the index was lost or corrupted.
+type cmdIndexRebuild struct {
+	cmdBase
+
+	numRecovered *atomic.Int64
+	numFailed    *atomic.Int64
+
+	wg    *sync.WaitGroup
+	queue chan archiving.BackupFileInfo
+}
+
+// Finished implements Command.
+func (c *cmdIndexRebuild) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdIndexRebuild) Run() {
+	defer c.signalFinished()
+
+	c.output.progress.Start()
+	tracker := c.output.progress.Tracker()
+
+	for i := 0; i < c.args.degreeOfParallelism; i++ {
+		c.wg.Add(1)
+		go func(id int) {
+			defer c.wg.Done()
+			c.handleRecoverQueue(id)
+		}(i)
+	}
+
+	numBackupFiles := 0
+	err := c.archive.ListBackupFiles(func(info archiving.BackupFileInfo) error {
+		numBackupFiles++
+		tracker.Discovered(info.Size)
+		tracker.Queued(info.Size)
+		c.queue <- info
+
+		return nil
+	})
+	tracker.DiscoveryComplete()
+
+	if nil != err {
+		glog.Errorf("Failed to list backup files: %v", err)
+		c.output.Fatal(err)
+		return
+	}
+
+	glog.Infof("Found %d backup file(s).", numBackupFiles)
+}
+
+// Stop implements Command.
+func (c *cmdIndexRebuild) Stop() {
+	close(c.queue)
+	c.wg.Wait()
+
+	// Without any headers, chances are the password is wrong. Keep the index
+	// as it is rather than replacing it with an empty one.
+	if 0 == c.numRecovered.Load() && c.numFailed.Load() > 0 {
+		glog.Error("No backup file had a readable header, keeping the archive index. Did you provide the correct password?")
+		c.archive.DiscardIndexChanges()
+	}
+
+	c.stop()
+}
+
+func newIndexCommand(args []string) Command {
+	if len(args) < 1 {
+		glog.Exitln(expectedIndexCommands)
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "rebuild":
+		return newIndexRebuildCommand(args[1:])
+
+	default:
+		glog.Exitln(expectedIndexCommands)
+	}
+
+	return nil
+}
+
+func newIndexRebuildCommand(args []string) Command {
+	rebuildFlags := flag.NewFlagSet("index rebuild", flag.ExitOnError)
+	commonArgs := addCommonArgs(rebuildFlags)
+	rebuildFlags.Parse(args)
+
+	output := newRunOutput("index-rebuild", *commonArgs)
+	options := newArchiveOptions(*commonArgs)
+	// Without changes, there is no point in ignoring the index.
+	options.RebuildIndex = !commonArgs.whatIf
+	// A checkpoint would replace the index with a partially rebuilt one.
+	options.Checkpoints = archiving.CheckpointPolicy{}
+
+	return &cmdIndexRebuild{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchiveWithOptions(*commonArgs, options, true),
+			output:   output,
+			finished: make(chan bool),
+		},
+
+		numRecovered: &atomic.Int64{},
+		numFailed:    &atomic.Int64{},
+
+		wg:    &sync.WaitGroup{},
+		queue: make(chan archiving.BackupFileInfo, commonArgs.degreeOfParallelism*2),
+	}
+}
+
+func (c *cmdIndexRebuild) handleRecoverQueue(id int) {
+	numSuccessful, numFailed := 0, 0
+
+	for {
+		info, isOpen := <-c.queue
+		if !isOpen {
+			break
+		}
+
+		glog.V(1).Infof("[Rebuild-%d] Read header of backup file '%s' ...", id, info.BlobID)
+
+		start := time.Now()
+		entry, err := c.archive.ReadBackupFileHeader(info.BlobID)
+		if nil == err && nil == entry {
+			err = archiving.BlobHeaderMissing
+		}
+		if nil != err {
+			numFailed++
+			c.numFailed.Add(1)
+			c.output.FileFailed("recover", info.BlobID, info.Size, time.Since(start), err)
+			glog.Errorf("[Rebuild-%d] Failed to recover backup file '%s': %v", id, info.BlobID, err)
+			continue
+		}
+
+		entry.StoredSize = info.Size
+		entry.BlobID = info.BlobID
+		if !c.args.whatIf {
+			c.archive.Recover(*entry)
+		}
+
+		numSuccessful++
+		c.numRecovered.Add(1)
+		c.output.FileDone("recover", entry.RelPath, info.Size, time.Since(start))
+	}
+
+	glog.Infof("[Rebuild-%d] Finished. Successfully recovered %d file(s), failed to recover %d file(s).",
+		id, numSuccessful, numFailed)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rokeller/bart/domain"
+	"github.com/rokeller/bart/progress"
+)
+
+type cmdList struct {
+	cmdBase
+
+	prefix string
+}
+
+type entryEvent struct {
+	Event        string     `json:"event"`
+	Path         string     `json:"path"`
+	LastModified time.Time  `json:"lastModified"`
+	Size         int64      `json:"size,omitempty"`
+	StoredSize   int64      `json:"storedSize,omitempty"`
+	Digest       string     `json:"digest,omitempty"`
+	BlobID       string     `json:"blobId,omitempty"`
+	BackupTime   *time.Time `json:"backupTime,omitempty"`
+	TrashTime    *time.Time `json:"trashTime,omitempty"`
+	Stream       bool       `json:"stream,omitempty"`
+}
+
+type totalsEvent struct {
+	Event       string `json:"event"`
+	Files       int64  `json:"files"`
+	Bytes       int64  `json:"bytes"`
+	StoredBytes int64  `json:"storedBytes"`
+}
+
+// Finished implements Command.
+func (c *cmdList) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdList) Run() {
+	defer c.signalFinished()
+
+	entries := []domain.Entry{}
+	c.archive.WalkBackup(func(entry domain.Entry) {
+		if strings.HasPrefix(entry.RelPath, c.prefix) {
+			entries = append(entries, entry)
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RelPath < entries[j].RelPath
+	})
+
+	totals := totalsEvent{Event: "totals"}
+	for _, entry := range entries {
+		totals.Files++
+		totals.Bytes += entry.Size
+		totals.StoredBytes += entry.StoredSize
+
+		c.output.print(formatEntry(entry), newEntryEvent(entry))
+	}
+
+	c.output.print(fmt.Sprintf("%d file(s), %s, %s stored", totals.Files,
+		progress.FormatBytes(totals.Bytes), progress.FormatBytes(totals.StoredBytes)),
+		totals)
+}
+
+// Stop implements Command.
+func (c *cmdList) Stop() {
+	c.stop()
+}
+
+func newListCommand(args []string) Command {
+	listFlags := flag.NewFlagSet("list", flag.ExitOnError)
+	prefix := listFlags.String("prefix", "", "Only list files whose relative path starts with the prefix.")
+	commonArgs := addCommonArgs(listFlags)
+	listFlags.Parse(args)
+
+	// There is no point in reporting progress for listing the archive.
+	commonArgs.progressMode = "none"
+
+	output := newRunOutput("list", *commonArgs)
+
+	return &cmdList{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchive(*commonArgs, false),
+			output:   output,
+			finished: make(chan bool),
+			readOnly: true,
+		},
+
+		prefix: *prefix,
+	}
+}
+
+// formatEntry formats an entry for text output. Details not known for entries
+// backed up by earlier versions are shown as '-'.
+func formatEntry(entry domain.Entry) string {
+	size, storedSize, backupTime, digest := "-", "-", "-", "-"
+	if 0 != entry.BackupTime {
+		size = progress.FormatBytes(entry.Size)
+		storedSize = progress.FormatBytes(entry.StoredSize)
+		backupTime = time.Unix(entry.BackupTime, 0).Format(time.DateTime)
+	}
+	if len(entry.Digest) > 0 {
+		digest = hex.EncodeToString(entry.Digest)[:12]
+	}
+
+	return fmt.Sprintf("%10s  %10s  %19s  %12s  %s", size, storedSize,
+		backupTime, digest, entry.RelPath)
+}
+
+func newEntryEvent(entry domain.Entry) entryEvent {
+	event := entryEvent{
+		Event:        "entry",
+		Path:         entry.RelPath,
+		LastModified: time.Unix(entry.Timestamp, 0),
+		Size:         entry.Size,
+		StoredSize:   entry.StoredSize,
+		Digest:       hex.EncodeToString(entry.Digest),
+		BlobID:       entry.BlobID,
+		Stream:       entry.Stream,
+	}
+	if 0 != entry.BackupTime {
+		backupTime := time.Unix(entry.BackupTime, 0)
+		event.BackupTime = &backupTime
+	}
+
+	return event
+}
@@ -5,10 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
 	"github.com/rokeller/bart/domain"
 )
 
@@ -28,6 +31,19 @@ func (c *cmdRestore) Finished() <-chan bool {
 func (c *cmdRestore) Run() {
 	defer c.signalFinished()
 
+	if !c.runPreHook() {
+		return
+	}
+
+	if err := c.checkRoots(); nil != err {
+		glog.Error(err)
+		c.output.Fatal(err)
+		return
+	}
+
+	c.output.progress.Start()
+	tracker := c.output.progress.Tracker()
+
 	for i := 0; i < c.args.degreeOfParallelism; i++ {
 		c.wg.Add(1)
 		go func(id int) {
@@ -39,15 +55,61 @@ func (c *cmdRestore) Run() {
 	// Find files that are missing locally.
 	c.archive.FindLocallyMissing(func(entry domain.Entry) {
 		// The item is present in the backup, but not locally.
-		absLocalPath := path.Join(c.args.localRoot, entry.RelPath)
+		absLocalPath, found := c.archive.AbsPath(entry.RelPath)
+		if !found {
+			// Only the roots that are mapped are restored.
+			glog.V(3).Infof("Skipping '%s' of a root that is not restored.", entry.RelPath)
+			return
+		}
+		tracker.Discovered(entry.Size)
 		_, err := os.Stat(absLocalPath)
 		if errors.Is(err, os.ErrNotExist) {
+			tracker.Queued(entry.Size)
 			c.queue <- entry
 		} else if nil != err {
 			glog.Errorf("Failed to check for local file '%s': %v",
 				entry.RelPath, err)
 		}
 	})
+	tracker.DiscoveryComplete()
+}
+
+// checkRoots fails when none of the roots in the archive index is mapped to a
+// local directory, since nothing would be restored, and warns about the roots
+// that are not restored.
+func (c *cmdRestore) checkRoots() error {
+	numMapped := 0
+	unmapped := map[string]bool{}
+	c.archive.WalkBackup(func(entry domain.Entry) {
+		if _, found := c.archive.AbsPath(entry.RelPath); found {
+			numMapped++
+		} else {
+			root, _ := archiving.SplitRootedPath(entry.RelPath)
+			unmapped[root] = true
+		}
+	})
+	if 0 == len(unmapped) {
+		return nil
+	}
+
+	names := make([]string, 0, len(unmapped))
+	for root := range unmapped {
+		if "" == root {
+			// The files backed up with -path.
+			root = "-path"
+		}
+		names = append(names, root)
+	}
+	sort.Strings(names)
+
+	if 0 == numMapped {
+		return fmt.Errorf("none of the roots %s of the archive is mapped to a local directory; use -roots to map them",
+			strings.Join(names, ", "))
+	}
+	glog.Warningf("The roots %s of the archive are not restored; use -roots to map them.",
+		strings.Join(names, ", "))
+
+	return nil
 }
 
 // Stop implements Command.
@@ -60,13 +122,20 @@ func (c *cmdRestore) Stop() {
 
 func newRestoreCommand(args []string) Command {
 	restoreFlags := flag.NewFlagSet("restore", flag.ExitOnError)
+	hookArgs := addHookArgs(restoreFlags)
 	commonArgs := addCommonArgs(restoreFlags)
 	restoreFlags.Parse(args)
 
+	output := newRunOutput("restore", *commonArgs).withHooks(*hookArgs, *commonArgs)
+	options := newArchiveOptions(*commonArgs)
+	// Without -roots, all roots are restored to where they were backed up from.
+	options.RestoreRememberedRoots = "" == strings.TrimSpace(commonArgs.roots)
+
 	return &cmdRestore{
 		cmdBase: cmdBase{
 			args:     *commonArgs,
-			archive:  newArchive(*commonArgs),
+			archive:  newArchiveWithOptions(*commonArgs, options, false),
+			output:   output,
 			finished: make(chan bool),
 		},
 
@@ -89,17 +158,19 @@ func (c *cmdRestore) handleRestoreQueue(id int) {
 
 		if c.args.whatIf {
 			numSuccessful++
-			fmt.Println(entry.RelPath)
+			c.output.FileDone("restore", entry.RelPath, entry.Size, 0)
 			continue
 		}
 
+		start := time.Now()
 		if err := c.archive.Restore(entry); nil != err {
 			numFailed++
+			c.output.FileFailed("restore", entry.RelPath, entry.Size, time.Since(start), err)
 			glog.Errorf("[Restorer-%d] Restore of file '%s' failed: %v",
 				id, entry.RelPath, err)
 		} else {
 			numSuccessful++
-			fmt.Println(entry.RelPath)
+			c.output.FileDone("restore", entry.RelPath, entry.Size, time.Since(start))
 		}
 	}
 
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/domain"
+	"github.com/rokeller/bart/progress"
+)
+
+const expectedTrashCommands = "Expected trash command 'list', 'restore', or 'empty'."
+
+type TrashAction int
+
+const (
+	TrashActionList TrashAction = iota
+	TrashActionRestore
+	TrashActionEmpty
+)
+
+// cmdTrash manages the files moved to the trash by 'cleanup -l backup'.
+type cmdTrash struct {
+	cmdBase
+
+	action TrashAction
+	prefix string
+	// grace limits emptying the trash to files that have been in the trash
+	// for longer.
+	grace time.Duration
+
+	wg    *sync.WaitGroup
+	queue chan domain.Entry
+}
+
+// Finished implements Command.
+func (c *cmdTrash) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdTrash) Run() {
+	defer c.signalFinished()
+
+	entries := []domain.Entry{}
+	cutoff := time.Now().Add(-c.grace).Unix()
+	c.archive.WalkTrash(func(entry domain.Entry) {
+		if strings.HasPrefix(entry.RelPath, c.prefix) &&
+			(TrashActionEmpty != c.action || entry.TrashTime <= cutoff) {
+			entries = append(entries, entry)
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RelPath < entries[j].RelPath
+	})
+
+	switch c.action {
+	case TrashActionList:
+		c.list(entries)
+	case TrashActionRestore:
+		c.restore(entries)
+	case TrashActionEmpty:
+		c.empty(entries)
+
+	default:
+		glog.Fatalf("Unhandled trash action %d.", c.action)
+	}
+}
+
+// Stop implements Command.
+func (c *cmdTrash) Stop() {
+	close(c.queue)
+	c.wg.Wait()
+
+	c.stop()
+}
+
+func newTrashCommand(args []string) Command {
+	if len(args) < 1 {
+		glog.Exitln(expectedTrashCommands)
+	}
+
+	var action TrashAction
+	switch strings.ToLower(args[0]) {
+	case "list":
+		action = TrashActionList
+	case "restore":
+		action = TrashActionRestore
+	case "empty":
+		action = TrashActionEmpty
+
+	default:
+		glog.Exitln(expectedTrashCommands)
+	}
+
+	trashFlags := flag.NewFlagSet("trash "+args[0], flag.ExitOnError)
+	prefix := trashFlags.String("prefix", "", "Only handle files in the trash whose relative path starts with the prefix.")
+	grace := trashFlags.Duration("grace", 0, "When emptying the trash, only delete files that have been in the trash for longer than this.")
+	commonArgs := addCommonArgs(trashFlags)
+	trashFlags.Parse(args[1:])
+
+	if TrashActionList == action {
+		// There is no point in reporting progress for listing the trash.
+		commonArgs.progressMode = "none"
+	}
+
+	output := newRunOutput("trash-"+strings.ToLower(args[0]), *commonArgs)
+
+	return &cmdTrash{
+		cmdBase: cmdBase{
+			args:     *commonArgs,
+			archive:  newArchive(*commonArgs, TrashActionList != action),
+			output:   output,
+			finished: make(chan bool),
+			readOnly: TrashActionList == action,
+		},
+
+		action: action,
+		prefix: *prefix,
+		grace:  *grace,
+
+		wg:    &sync.WaitGroup{},
+		queue: make(chan domain.Entry, commonArgs.degreeOfParallelism*2),
+	}
+}
+
+func (c *cmdTrash) list(entries []domain.Entry) {
+	var size, storedSize int64
+	for _, entry := range entries {
+		size += entry.Size
+		storedSize += entry.StoredSize
+
+		event := newEntryEvent(entry)
+		event.Event = "trashed"
+		trashTime := time.Unix(entry.TrashTime, 0)
+		event.TrashTime = &trashTime
+
+		c.output.print(fmt.Sprintf("%19s  %s", trashTime.Format(time.DateTime),
+			formatEntry(entry)), event)
+	}
+
+	c.output.print(fmt.Sprintf("%d file(s) in the trash, %s, %s stored", len(entries),
+		progress.FormatBytes(size), progress.FormatBytes(storedSize)),
+		totalsEvent{
+			Event:       "totals",
+			Files:       int64(len(entries)),
+			Bytes:       size,
+			StoredBytes: storedSize,
+		})
+}
+
+func (c *cmdTrash) restore(entries []domain.Entry) {
+	c.output.progress.Start()
+	tracker := c.output.progress.Tracker()
+
+	for _, entry := range entries {
+		tracker.Discovered(entry.StoredSize)
+		if !c.args.whatIf {
+			c.archive.Untrash(entry)
+		}
+		c.output.FileDone("untrash", entry.RelPath, entry.StoredSize, 0)
+	}
+	tracker.DiscoveryComplete()
+}
+
+func (c *cmdTrash) empty(entries []domain.Entry) {
+	c.output.progress.Start()
+	tracker := c.output.progress.Tracker()
+
+	for i := 0; i < c.args.degreeOfParallelism; i++ {
+		c.wg.Add(1)
+		go func(id int) {
+			defer c.wg.Done()
+			c.handleDeleteQueue(id)
+		}(i)
+	}
+
+	for _, entry := range entries {
+		tracker.Discovered(entry.StoredSize)
+		tracker.Queued(entry.StoredSize)
+		c.queue <- entry
+	}
+	tracker.DiscoveryComplete()
+}
+
+func (c *cmdTrash) handleDeleteQueue(id int) {
+	numSuccessful, numFailed := 0, 0
+
+	for {
+		entry, isOpen := <-c.queue
+		if !isOpen {
+			break
+		}
+
+		glog.V(1).Infof("[Trash-%d] Delete file '%s' from backup ...", id, entry.RelPath)
+
+		if c.args.whatIf {
+			numSuccessful++
+			c.output.FileDone("delete-from-backup", entry.RelPath, entry.StoredSize, 0)
+			continue
+		}
+
+		start := time.Now()
+		if err := c.archive.Delete(entry); nil != err {
+			numFailed++
+			c.output.FileFailed("delete-from-backup", entry.RelPath, entry.StoredSize,
+				time.Since(start), err)
+			glog.Errorf("[Trash-%d] Deletion of file '%s' failed: %v", id, entry.RelPath, err)
+		} else {
+			numSuccessful++
+			c.output.FileDone("delete-from-backup", entry.RelPath, entry.StoredSize,
+				time.Since(start))
+		}
+	}
+
+	glog.Infof("[Trash-%d] Finished. Successfully deleted %d file(s), failed to delete %d file(s).",
+		id, numSuccessful, numFailed)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+// cmdUnlock forcibly removes the lock on an archive, e.g. after a crash of the
+// process holding it. It does not need the archive's password.
+type cmdUnlock struct {
+	storageProvider archiving.StorageProvider
+	finished        chan bool
+	failed          bool
+}
+
+// Finished implements Command.
+func (c *cmdUnlock) Finished() <-chan bool {
+	return c.finished
+}
+
+// Run implements Command.
+func (c *cmdUnlock) Run() {
+	defer func() {
+		c.finished <- true
+	}()
+
+	if err := c.storageProvider.BreakLock(); nil != err {
+		glog.Errorf("Failed to unlock the archive: %v", err)
+		c.failed = true
+	} else {
+		glog.Info("The archive has been unlocked.")
+	}
+}
+
+// Stop implements Command.
+func (c *cmdUnlock) Stop() {
+}
+
+// Summarize implements Command.
+func (c *cmdUnlock) Summarize(interrupted bool) int {
+	if c.failed {
+		return exitFatal
+	} else if interrupted {
+		return exitInterrupted
+	}
+
+	return exitSuccess
+}
+
+func newUnlockCommand(args []string) Command {
+	unlockFlags := flag.NewFlagSet("unlock", flag.ExitOnError)
+	commonArgs := addCommonArgs(unlockFlags)
+	unlockFlags.Parse(args)
+
+	return &cmdUnlock{
+		storageProvider: newArchiveStorageProvider(*commonArgs),
+		finished:        make(chan bool),
+	}
+}
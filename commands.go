@@ -6,38 +6,69 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/progress"
+	"github.com/rokeller/bart/providers/retrying"
+	"github.com/rokeller/bart/throttling"
 )
 
 type cmdBase struct {
 	args     commonArguments
 	archive  archiving.Archive
+	output   *runOutput
 	finished chan bool
+	// readOnly commands don't record their runs in the archive's history.
+	readOnly bool
 }
 
 type commonArguments struct {
 	backupName          string
 	localRoot           string
+	roots               string
 	degreeOfParallelism int
 	whatIf              bool
+	retry               retrying.Options
+	bwLimitUp           string
+	bwLimitDown         string
+	bwSchedule          string
+	lowIOPriority       bool
+	progressMode        string
+	progressInterval    time.Duration
+	outputFormat        string
+	noCache             bool
+	indexGenerations    int
+	checkpointInterval  time.Duration
+	checkpointEntries   int64
+	checkpointBytes     string
+	tags                string
+	passwordEnv         string
+	passwordFile        string
+	passwordCmd         string
+	keyFile             string
 }
 
 type Command interface {
 	Run()
 	Stop()
 	Finished() <-chan bool
+	// Summarize reports the summary of the command's run and returns the
+	// process exit code.
+	Summarize(interrupted bool) int
 }
 
 type commandFactory func([]string) Command
 
+const expectedCommands = "Expected command 'backup', 'restore', 'cleanup', 'gc', 'forget', 'list', 'cat', 'get', 'history', 'index', 'trash', or 'unlock'."
+
 func parseCommand() Command {
 	// The following is needed for glog, which puts its flags on the "shared" set.
 	flag.Parse()
 	allArgs := flag.Args()
 	if len(allArgs) < 1 {
-		glog.Exitln("Expected command 'backup', 'restore', or 'cleanup'.")
+		glog.Exitln(expectedCommands)
 	}
 
 	// Figure out what command we're dealing with first.
@@ -49,9 +80,27 @@ func parseCommand() Command {
 		cmdFactory = newRestoreCommand
 	case "cleanup":
 		cmdFactory = newCleanupCommand
+	case "gc":
+		cmdFactory = newGCCommand
+	case "forget":
+		cmdFactory = newForgetCommand
+	case "list":
+		cmdFactory = newListCommand
+	case "cat":
+		cmdFactory = newCatCommand
+	case "get":
+		cmdFactory = newGetCommand
+	case "history":
+		cmdFactory = newHistoryCommand
+	case "index":
+		cmdFactory = newIndexCommand
+	case "trash":
+		cmdFactory = newTrashCommand
+	case "unlock":
+		cmdFactory = newUnlockCommand
 
 	default:
-		glog.Exitln("Expected command 'backup', 'restore', or 'cleanup'.")
+		glog.Exitln(expectedCommands)
 	}
 
 	cmd := cmdFactory(allArgs[1:])
@@ -65,32 +114,176 @@ func addCommonArgs(flagset *flag.FlagSet) *commonArguments {
 		"name", "backup", "The name of the backup archive.")
 	flagset.StringVar(&commonArgs.localRoot,
 		"path", ".", "The path to the directory to backup and/or restore.")
+	flagset.StringVar(&commonArgs.roots,
+		"roots", "", "Comma-separated directories to backup and/or restore together, as 'name=dir' or 'dir' to name the root by the directory's base name; overrides -path.")
 	flagset.IntVar(&commonArgs.degreeOfParallelism,
 		"p", runtime.NumCPU(), "The degree of parallelism to use.")
 	flagset.BoolVar(&commonArgs.whatIf,
 		"whatif", false, "Set to true to see what bart would do without actually doing.")
+	flagset.IntVar(&commonArgs.retry.Attempts,
+		"retries", 5, "The maximum number of attempts for operations on the backup destination.")
+	flagset.DurationVar(&commonArgs.retry.InitialDelay,
+		"retry-delay", time.Second, "The delay before the first retry of a failed operation; doubled with every retry.")
+	flagset.DurationVar(&commonArgs.retry.MaxDelay,
+		"retry-max-delay", time.Minute, "The maximum delay between two attempts of a failed operation.")
+	flagset.StringVar(&commonArgs.bwLimitUp,
+		"bwlimit-up", "", "The maximum upload bandwidth in bytes per second, e.g. '512K' or '2M'.")
+	flagset.StringVar(&commonArgs.bwLimitDown,
+		"bwlimit-down", "", "The maximum download bandwidth in bytes per second, e.g. '512K' or '2M'.")
+	flagset.StringVar(&commonArgs.bwSchedule,
+		"bwlimit-schedule", "", "The times of day when bandwidth limits apply, e.g. '08:00-12:00,13:00-18:00'. Limits always apply when empty.")
+	flagset.BoolVar(&commonArgs.lowIOPriority,
+		"lowprio", false, "Set to true to use the lowest priority for local disk I/O.")
+	flagset.StringVar(&commonArgs.progressMode,
+		"progress", "auto", "How to report progress: 'bar' for a progress bar, 'log' for periodic log lines, 'none' to not report progress, or 'auto' to pick 'bar' on terminals and 'log' otherwise.")
+	flagset.DurationVar(&commonArgs.progressInterval,
+		"progress-interval", 10*time.Second, "The interval between progress log lines.")
+	flagset.StringVar(&commonArgs.outputFormat,
+		"output", "text", "The output format: 'text' to list affected files, 'json' for one JSON event per line and a final summary.")
+	flagset.BoolVar(&commonArgs.noCache,
+		"no-cache", false, "Set to true to always download the archive index instead of using locally cached copies.")
+	flagset.IntVar(&commonArgs.indexGenerations,
+		"index-generations", 3, "The number of generations to keep of the archive index, to fall back to when the newest one is corrupt.")
+	flagset.DurationVar(&commonArgs.checkpointInterval,
+		"checkpoint-interval", 30*time.Second, "The interval between checkpoints of the archive index; 0 to not upload checkpoints periodically.")
+	flagset.Int64Var(&commonArgs.checkpointEntries,
+		"checkpoint-entries", 0, "The number of changed files after which a checkpoint of the archive index is uploaded; 0 to ignore.")
+	flagset.StringVar(&commonArgs.checkpointBytes,
+		"checkpoint-bytes", "", "The number of bytes backed up after which a checkpoint of the archive index is uploaded, e.g. '1G'; empty to ignore.")
+
+	flagset.StringVar(&commonArgs.passwordEnv,
+		"password-env", "", "The name of the environment variable holding the password, instead of prompting for it.")
+	flagset.StringVar(&commonArgs.passwordFile,
+		"password-file", "", "The path of a file holding the password, instead of prompting for it; must only be readable by the owner.")
+	flagset.StringVar(&commonArgs.passwordCmd,
+		"password-cmd", "", "A command printing the password, e.g. 'pass show backup', instead of prompting for it.")
+	flagset.StringVar(&commonArgs.keyFile,
+		"keyfile", "", "The path of a file whose content is used as the password, e.g. random bytes; must only be readable by the owner.")
+	flagset.StringVar(&commonArgs.tags,
+		"tags", "", "Comma-separated tags to record with the run in the archive history, e.g. 'manual,before-upgrade'.")
 
 	updateFlags(flagset)
 
+	// All flags of the command are defined at this point, so the profile can
+	// provide their values; flags given on the command line override them.
+	loadProfile().apply(flagset)
+
 	return &commonArgs
 }
 
-func newArchive(args commonArguments) archiving.Archive {
+// newArchive creates the archive for the given arguments. Commands modifying
+// the archive must ask for exclusive access.
+func newArchive(args commonArguments, exclusive bool) archiving.Archive {
+	return newArchiveWithOptions(args, newArchiveOptions(args), exclusive)
+}
+
+// newArchiveWithOptions creates the archive for the given arguments and
+// options.
+func newArchiveWithOptions(args commonArguments, options archiving.Options, exclusive bool) archiving.Archive {
+	storageProvider := newArchiveStorageProvider(args)
+	exists, err := archiving.Exists(storageProvider)
+	if nil != err {
+		exitf("Failed to check for the archive: %v", err)
+	}
+	password := readPassword(args, !exists)
+	localContext := newLocalContext(args)
+	options.Exclusive = exclusive && !args.whatIf
+	options.Exit = exit
+	archive := archiving.NewArchive(password, localContext, storageProvider, options)
+
+	return archive
+}
+
+func newArchiveStorageProvider(args commonArguments) archiving.StorageProvider {
 	args.backupName = strings.TrimSpace(args.backupName)
 
 	if "" == strings.TrimSpace(args.backupName) {
-		glog.Exit("The backup name must not be empty.")
+		exit("The backup name must not be empty.")
 	} else {
 		verifyFlags()
 	}
 
-	password := readPassword()
-	rootDir, _ := filepath.Abs(os.ExpandEnv(args.localRoot))
-	localContext := archiving.NewLocalContext(rootDir)
-	storageProvider := newStorageProvider(args.backupName)
-	archive := archiving.NewArchive(password, localContext, storageProvider)
+	args.retry.Stop = stopping
 
-	return archive
+	return retrying.NewRetryingStorageProvider(
+		newStorageProvider(args.backupName), args.retry)
+}
+
+func newArchiveOptions(args commonArguments) archiving.Options {
+	schedule, err := throttling.ParseSchedule(args.bwSchedule)
+	if nil != err {
+		exitf("Invalid bandwidth limit schedule: %v", err)
+	}
+
+	up, err := throttling.ParseRate(args.bwLimitUp)
+	if nil != err {
+		exitf("Invalid upload bandwidth limit: %v", err)
+	}
+
+	down, err := throttling.ParseRate(args.bwLimitDown)
+	if nil != err {
+		exitf("Invalid download bandwidth limit: %v", err)
+	}
+
+	checkpointBytes, err := throttling.ParseSize(args.checkpointBytes)
+	if nil != err {
+		exitf("Invalid checkpoint bytes: %v", err)
+	}
+
+	if args.lowIOPriority {
+		if err := throttling.SetLowIOPriority(); nil != err {
+			glog.Warningf("Failed to lower I/O priority: %v", err)
+		}
+	}
+
+	return archiving.Options{
+		UploadLimiter:    throttling.NewLimiter(up, schedule),
+		DownloadLimiter:  throttling.NewLimiter(down, schedule),
+		IndexCacheDir:    indexCacheDir(args),
+		IndexGenerations: args.indexGenerations,
+		Checkpoints: archiving.CheckpointPolicy{
+			Interval: args.checkpointInterval,
+			Entries:  args.checkpointEntries,
+			Bytes:    checkpointBytes,
+		},
+	}
+}
+
+// indexCacheDir determines the directory to cache index shards in, e.g.
+// $XDG_CACHE_HOME/bart on Linux.
+func indexCacheDir(args commonArguments) string {
+	if args.noCache {
+		return ""
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if nil != err {
+		glog.Warningf("Cannot determine cache directory, not caching the archive index: %v", err)
+		return ""
+	}
+
+	return filepath.Join(cacheDir, "bart")
+}
+
+func newProgressReporter(args commonArguments) *progress.Reporter {
+	mode, err := progress.ParseMode(args.progressMode)
+	if nil != err {
+		glog.Exitf("Invalid progress mode: %v", err)
+	}
+
+	return progress.NewReporter(progress.NewTracker(), mode, args.progressInterval)
+}
+
+// runPreHook runs the pre-run hook, if any, and reports whether the run can
+// go on.
+func (c cmdBase) runPreHook() bool {
+	if err := c.output.hooks.runPre(); nil != err {
+		glog.Errorf("Aborting the run: %v", err)
+		c.output.Fatal(err)
+		return false
+	}
+
+	return true
 }
 
 func (c cmdBase) signalFinished() {
@@ -98,7 +291,65 @@ func (c cmdBase) signalFinished() {
 }
 
 func (c cmdBase) stop() {
+	c.output.progress.Stop()
+
 	if err := c.archive.Close(); nil != err {
 		glog.Errorf("Failed to close backup archive: %v", err)
+		c.output.Fatal(err)
+	}
+}
+
+func (c cmdBase) Summarize(interrupted bool) int {
+	summary := c.output.Summarize(interrupted)
+
+	// Record the run while the archive is still locked.
+	if !c.readOnly {
+		c.recordRun(summary)
+	}
+	c.archive.Release()
+	c.output.hooks.runPost(summary)
+
+	return summary.ExitCode
+}
+
+// parseTags parses a comma-separated list of tags.
+func parseTags(s string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); "" != tag {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+func (c cmdBase) recordRun(summary summaryEvent) {
+	host, err := os.Hostname()
+	if nil != err {
+		glog.Warningf("Failed to determine host name: %v", err)
+	}
+
+	record := archiving.RunRecord{
+		ID:              archiving.NewRunRecordID(summary.Start),
+		Command:         summary.Command,
+		Start:           summary.Start,
+		End:             summary.End,
+		Host:            host,
+		Status:          summary.Status,
+		WhatIf:          summary.WhatIf,
+		DiscoveredFiles: summary.DiscoveredFiles,
+		DoneFiles:       summary.DoneFiles,
+		DoneBytes:       summary.DoneBytes,
+		FailedFiles:     summary.FailedFiles,
+		FailedBytes:     summary.FailedBytes,
+		Errors:          c.output.Errors(),
+		Tags:            parseTags(c.args.tags),
+	}
+
+	if err := c.archive.AppendRunRecord(record); nil != err {
+		glog.Errorf("Failed to record run in the archive history: %v", err)
+	} else {
+		glog.V(1).Infof("Recorded run '%s' in the archive history.", record.ID)
 	}
 }
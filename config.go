@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	profileName = flag.String("profile", "", "The name of the profile from the config file to use.")
+	configPath  = flag.String("config", "", "The path of the config file; defaults to 'bart/config' in the user's config directory, e.g. '~/.config/bart/config'.")
+)
+
+// config is the content of the config file. Each profile maps the names of
+// command line flags (without the leading '-') to their values for all
+// commands, and has sections with values for single commands only, e.g.
+//
+//	profiles:
+//	  photos:
+//	    name: photos
+//	    path: $HOME/Pictures
+//	    t: /mnt/backup
+//	    p: 4
+//	    commands:
+//	      gc:
+//	        grace: 48h
+//	      trash empty:
+//	        grace: 720h
+type config struct {
+	Profiles map[string]profile `yaml:"profiles"`
+}
+
+type profile struct {
+	Values map[string]string `yaml:",inline"`
+	// Commands maps the names of commands, like 'gc' or 'trash empty', to the
+	// values only used by them.
+	Commands map[string]map[string]string `yaml:"commands"`
+}
+
+// commandOnlyFlags are the flags which override safety checks, or whose
+// meaning differs between the commands. Profiles can only set them for single
+// commands, so they don't apply to commands they weren't meant for.
+var commandOnlyFlags = map[string]bool{
+	"force": true,
+	"yes":   true,
+	"grace": true,
+}
+
+// loadProfile loads the profile selected with -profile, or an empty profile if
+// none is selected.
+func loadProfile() profile {
+	if "" == *profileName {
+		return profile{}
+	}
+
+	path := *configPath
+	if "" == path {
+		configDir, err := os.UserConfigDir()
+		if nil != err {
+			glog.Exitf("Cannot determine config directory: %v", err)
+		}
+		path = filepath.Join(configDir, "bart", "config")
+	}
+
+	data, err := os.ReadFile(path)
+	if nil != err {
+		glog.Exitf("Failed to read config file: %v", err)
+	}
+
+	p, err := parseProfile(data, *profileName)
+	if nil != err {
+		glog.Exitf("Failed to load the profile from the config file '%s': %v", path, err)
+	}
+	glog.V(1).Infof("Using profile '%s' from config file '%s'.", *profileName, path)
+
+	return p
+}
+
+// parseProfile parses the config file data and returns the profile with the
+// given name.
+func parseProfile(data []byte, name string) (profile, error) {
+	cfg := config{}
+	if err := yaml.Unmarshal(data, &cfg); nil != err {
+		return profile{}, err
+	}
+
+	p, found := cfg.Profiles[name]
+	if !found {
+		return profile{}, fmt.Errorf("the profile '%s' was not found", name)
+	}
+
+	for flagName := range p.Values {
+		if commandOnlyFlags[flagName] {
+			return profile{}, fmt.Errorf("'%s' can only be set for single commands in the 'commands' of profile '%s'", flagName, name)
+		}
+	}
+
+	return p, nil
+}
+
+// apply sets the flags of the given flag set to the values of the profile,
+// first those for all commands, then those for the flag set's command. It
+// must be called before parsing the command line, so that flags given there
+// override the profile. Values for flags the command doesn't have are ignored
+// when they are for all commands, since those are shared by all commands.
+func (p profile) apply(flags *flag.FlagSet) {
+	for name, value := range p.Values {
+		if nil == flags.Lookup(name) {
+			glog.V(1).Infof("Ignoring '%s' from profile, which '%s' does not use.", name, flags.Name())
+			continue
+		}
+
+		if err := flags.Set(name, value); nil != err {
+			glog.Exitf("Invalid value for '%s' in profile '%s': %v", name, *profileName, err)
+		}
+	}
+
+	for name, value := range p.Commands[flags.Name()] {
+		if nil == flags.Lookup(name) {
+			glog.Exitf("The flag '%s' for '%s' in profile '%s' does not exist.", name, flags.Name(), *profileName)
+		}
+
+		if err := flags.Set(name, value); nil != err {
+			glog.Exitf("Invalid value for '%s' for '%s' in profile '%s': %v", name, flags.Name(), *profileName, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+profiles:
+  photos:
+    name: photos
+    p: 4
+    keep-daily: 7
+    commands:
+      gc:
+        grace: 48h
+      trash empty:
+        grace: 720h
+  unsafe:
+    force: true
+`
+
+// newTestFlags creates a flag set like the gc command's.
+func newTestFlags(name string) (*flag.FlagSet, *string, *int, *time.Duration) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	backupName := flags.String("name", "backup", "")
+	parallelism := flags.Int("p", 1, "")
+	grace := flags.Duration("grace", 24*time.Hour, "")
+
+	return flags, backupName, parallelism, grace
+}
+
+func TestParseProfile(t *testing.T) {
+	p, err := parseProfile([]byte(testConfig), "photos")
+	if nil != err {
+		t.Fatalf("parsing the profile failed: %v", err)
+	}
+
+	if "photos" != p.Values["name"] || "4" != p.Values["p"] || "7" != p.Values["keep-daily"] {
+		t.Errorf("got values %v", p.Values)
+	}
+	if _, found := p.Values["commands"]; found {
+		t.Error("the commands are a value for all commands")
+	}
+	if "48h" != p.Commands["gc"]["grace"] || "720h" != p.Commands["trash empty"]["grace"] {
+		t.Errorf("got commands %v", p.Commands)
+	}
+}
+
+func TestParseProfileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		profile string
+	}{
+		{"profile not found", testConfig, "other"},
+		{"safety override for all commands", testConfig, "unsafe"},
+		{"grace for all commands", "profiles:\n  p:\n    grace: 1h\n", "p"},
+		{"yes for all commands", "profiles:\n  p:\n    yes: true\n", "p"},
+		{"invalid YAML", "profiles: [", "p"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := parseProfile([]byte(test.config), test.profile); nil == err {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestProfileApply(t *testing.T) {
+	p, err := parseProfile([]byte(testConfig), "photos")
+	if nil != err {
+		t.Fatalf("parsing the profile failed: %v", err)
+	}
+
+	tests := []struct {
+		command         string
+		args            []string
+		wantName        string
+		wantParallelism int
+		wantGrace       time.Duration
+	}{
+		{"gc", nil, "photos", 4, 48 * time.Hour},
+		{"trash empty", nil, "photos", 4, 720 * time.Hour},
+		// Values for other commands don't apply.
+		{"forget", nil, "photos", 4, 24 * time.Hour},
+		// The command line overrides the profile.
+		{"gc", []string{"-name", "other", "-grace", "1h"}, "other", 4, time.Hour},
+		{"forget", []string{"-p", "2"}, "photos", 2, 24 * time.Hour},
+	}
+
+	for _, test := range tests {
+		t.Run(test.command, func(t *testing.T) {
+			flags, backupName, parallelism, grace := newTestFlags(test.command)
+			p.apply(flags)
+			if err := flags.Parse(test.args); nil != err {
+				t.Fatalf("parsing the arguments failed: %v", err)
+			}
+
+			if test.wantName != *backupName || test.wantParallelism != *parallelism || test.wantGrace != *grace {
+				t.Errorf("got name '%s', p %d and grace %v, want '%s', %d and %v",
+					*backupName, *parallelism, *grace, test.wantName, test.wantParallelism, test.wantGrace)
+			}
+		})
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testConfig), 0600); nil != err {
+		t.Fatalf("writing the config file failed: %v", err)
+	}
+
+	defer func(name, config string) {
+		*profileName, *configPath = name, config
+	}(*profileName, *configPath)
+
+	*profileName, *configPath = "", path
+	if p := loadProfile(); 0 != len(p.Values) || 0 != len(p.Commands) {
+		t.Errorf("got profile %v without selecting one", p)
+	}
+
+	*profileName = "photos"
+	if p := loadProfile(); "photos" != p.Values["name"] {
+		t.Errorf("got profile %v, want 'photos'", p)
+	}
+}
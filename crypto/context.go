@@ -3,7 +3,9 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"io"
 	"time"
 
@@ -83,6 +85,24 @@ func (c AesOfbContext) Encrypt(w io.Writer) (io.WriteCloser, error) {
 	return encryptingWriter, nil
 }
 
+// keyCheckMessage is authenticated with the key to create the key check.
+var keyCheckMessage = []byte("bart key check")
+
+// KeyCheck creates a value to verify the key with, which doesn't reveal the
+// key.
+func (c AesOfbContext) KeyCheck() []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(keyCheckMessage)
+
+	return mac.Sum(nil)
+}
+
+// VerifyKeyCheck determines if the given key check was created with the same
+// key.
+func (c AesOfbContext) VerifyKeyCheck(keyCheck []byte) bool {
+	return hmac.Equal(keyCheck, c.KeyCheck())
+}
+
 func deriveKey(password string, s settings.Settings) []byte {
 	startTime := time.Now()
 	key, err := scrypt.Key([]byte(password), s.Salt(), 1<<18, 8, 1, 32)
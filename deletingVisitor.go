@@ -2,22 +2,31 @@ package main
 
 import (
 	"io/fs"
-	"path"
 
+	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/progress"
 )
 
+// deletingVisitor finds the local files that are missing in the backup. The
+// files are only collected, so they can be checked before deleting any of
+// them.
 type deletingVisitor struct {
-	a       archiving.Archive
-	rootDir string
-	queue   chan<- deleteMessage
+	a          archiving.Archive
+	tracker    *progress.Tracker
+	numFiles   *int
+	candidates *[]deleteFromLocal
 }
 
-func NewDeletingVisitor(a archiving.Archive, rootDir string, queue chan<- deleteMessage) deletingVisitor {
+func NewDeletingVisitor(
+	a archiving.Archive,
+	tracker *progress.Tracker,
+) deletingVisitor {
 	v := deletingVisitor{
-		a:       a,
-		rootDir: rootDir,
-		queue:   queue,
+		a:          a,
+		tracker:    tracker,
+		numFiles:   new(int),
+		candidates: &[]deleteFromLocal{},
 	}
 
 	return v
@@ -28,11 +37,32 @@ func (v deletingVisitor) VisitDir(path string, d fs.DirEntry) {
 }
 
 func (v deletingVisitor) VisitFile(relPath string, f fs.DirEntry) {
+	var size int64
+	if info, err := f.Info(); nil != err {
+		glog.Errorf("Couldn't get details of file '%s': %v", relPath, err)
+	} else {
+		size = info.Size()
+	}
+
+	*v.numFiles++
+	v.tracker.Discovered(size)
 	entry := v.a.GetEntry(relPath)
 	if nil == entry {
-		v.queue <- deleteFromLocal{
+		absolutePath, _ := v.a.AbsPath(relPath)
+		*v.candidates = append(*v.candidates, deleteFromLocal{
 			relPath:      relPath,
-			absolutePath: path.Join(v.rootDir, relPath),
-		}
+			absolutePath: absolutePath,
+			size:         size,
+		})
 	}
 }
+
+// NumFiles returns the number of local files visited.
+func (v deletingVisitor) NumFiles() int {
+	return *v.numFiles
+}
+
+// Candidates returns the local files that are missing in the backup.
+func (v deletingVisitor) Candidates() []deleteFromLocal {
+	return *v.candidates
+}
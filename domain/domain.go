@@ -1,4 +1,6 @@
 //go:generate protoc --go_out=. index.proto
 //go:generate protoc --go_out=. settings.proto
+//go:generate protoc --go_out=. history.proto
+//go:generate protoc --go_out=. blob.proto
 
 package domain
@@ -11,9 +11,31 @@ type Entry struct {
 	EntryMetadata
 }
 
-// EntryMetadata holds the metadata for a file entry in the index.
+// EntryMetadata holds the metadata for a file entry in the index. All but the
+// Timestamp are zero for entries backed up by earlier versions.
 type EntryMetadata struct {
+	// Timestamp is the time the file was last modified, in seconds since the
+	// Unix epoch.
 	Timestamp int64
+	// Size is the size of the file in bytes.
+	Size int64
+	// StoredSize is the size of the encrypted file in the backup destination.
+	StoredSize int64
+	// Digest is the SHA-256 digest of the file's content.
+	Digest []byte
+	// BlobID identifies the encrypted file in the backup destination. It is
+	// empty for entries backed up by earlier versions, whose encrypted file is
+	// identified by the hash of the relative path.
+	BlobID string
+	// BackupTime is the time the file was backed up, in seconds since the
+	// Unix epoch.
+	BackupTime int64
+	// TrashTime is the time the file was moved to the trash, in seconds since
+	// the Unix epoch, or zero if the file is not in the trash.
+	TrashTime int64
+	// Stream is true for files backed up from a stream, e.g. stdin, which
+	// have no local file.
+	Stream bool
 }
 
 // Hash creates the SHA1 has for the entry's relative path.
@@ -21,6 +43,16 @@ func (e *Entry) Hash() string {
 	return relPathHash(e.RelPath)
 }
 
+// IsHash determines if s looks like a hash of a relative path.
+func IsHash(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+
+	_, err := hex.DecodeString(s)
+	return nil == err
+}
+
 // relPathHash creates the SHA1 hash for the given relative path.
 func relPathHash(relPath string) string {
 	hash := sha1.Sum([]byte(relPath))
@@ -9,7 +9,9 @@ require (
 	github.com/golang/glog v1.2.5
 	github.com/howeyc/gopass v0.0.0-20210920133722-c8aef6fb66ef
 	golang.org/x/crypto v0.51.0
+	golang.org/x/term v0.43.0
 	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,6 +23,5 @@ require (
 	github.com/pkg/browser v0.0.0-20240102092130-5ac0b6a4141c // indirect
 	golang.org/x/net v0.53.0 // indirect
 	golang.org/x/sys v0.44.0 // indirect
-	golang.org/x/term v0.43.0 // indirect
 	golang.org/x/text v0.37.0 // indirect
 )
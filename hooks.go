@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// hookArguments holds the commands to run around a command's run.
+type hookArguments struct {
+	pre  string
+	post string
+	fail string
+}
+
+// hooks runs the commands around a command's run through the shell. The
+// commands get details of the run in environment variables starting with
+// 'BART_'.
+type hooks struct {
+	hookArguments
+	env []string
+}
+
+// addHookArgs adds the flags for hooks to the flag set of a command.
+func addHookArgs(flagset *flag.FlagSet) *hookArguments {
+	hookArgs := hookArguments{}
+	flagset.StringVar(&hookArgs.pre,
+		"pre-hook", "", "A command to run before the run starts, e.g. to dump a database; the run is aborted when it fails.")
+	flagset.StringVar(&hookArgs.post,
+		"post-hook", "", "A command to run after the run, also when the pre-hook aborted it, e.g. to send a notification; it gets the JSON summary of the run on stdin.")
+	flagset.StringVar(&hookArgs.fail,
+		"fail-hook", "", "A command to run for each file that could not be processed; it gets the JSON event of the file on stdin.")
+
+	return &hookArgs
+}
+
+func newHooks(hookArgs hookArguments, command string, args commonArguments) hooks {
+	return hooks{
+		hookArguments: hookArgs,
+		env: append(os.Environ(),
+			"BART_COMMAND="+command,
+			"BART_NAME="+args.backupName,
+			"BART_WHATIF="+strconv.FormatBool(args.whatIf),
+		),
+	}
+}
+
+// runPre runs the pre-run hook, if any. The run must be aborted when it fails.
+func (h hooks) runPre() error {
+	if "" == h.pre {
+		return nil
+	}
+
+	glog.V(1).Infof("Running pre-run hook '%s' ...", h.pre)
+	if err := h.run(h.pre, nil, nil); nil != err {
+		return fmt.Errorf("the pre-run hook failed: %v", err)
+	}
+
+	return nil
+}
+
+// runPost runs the post-run hook, if any, with the summary of the run. It also
+// runs when the pre-run hook failed, to report the aborted run.
+func (h hooks) runPost(summary summaryEvent) {
+	if "" == h.post {
+		return
+	}
+
+	data, err := json.Marshal(summary)
+	if nil != err {
+		glog.Errorf("Failed to marshal summary for post-run hook: %v", err)
+		return
+	}
+
+	glog.V(1).Infof("Running post-run hook '%s' ...", h.post)
+	if err := h.run(h.post, data, []string{
+		"BART_STATUS=" + summary.Status,
+		"BART_EXIT_CODE=" + strconv.Itoa(summary.ExitCode),
+		"BART_SUMMARY=" + string(data),
+	}); nil != err {
+		glog.Warningf("The post-run hook failed: %v", err)
+	}
+}
+
+// runFail runs the failure hook, if any, for a file that could not be
+// processed.
+func (h hooks) runFail(event fileEvent) {
+	if "" == h.fail {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if nil != err {
+		glog.Errorf("Failed to marshal file event for failure hook: %v", err)
+		return
+	}
+
+	if err := h.run(h.fail, data, []string{
+		"BART_ACTION=" + event.Action,
+		"BART_FILE=" + event.Path,
+		"BART_ERROR=" + event.Error,
+	}); nil != err {
+		glog.Warningf("The failure hook for '%s' failed: %v", event.Path, err)
+	}
+}
+
+func (h hooks) run(command string, input []byte, env []string) error {
+	cmd := shellCommand(command)
+	// Failure hooks run concurrently, so they must not share the environment.
+	cmd.Env = slices.Concat(h.env, env)
+	cmd.Stdin = bytes.NewReader(input)
+	// Keep stdout for the output of bart itself.
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// shellCommand creates a command to run the given command line through the
+// shell.
+func shellCommand(command string) *exec.Cmd {
+	if "windows" == runtime.GOOS {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("sh", "-c", command)
+}
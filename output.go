@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/progress"
+)
+
+type outputFormat int
+
+const (
+	outputText outputFormat = iota
+	outputJSON
+)
+
+const (
+	exitSuccess        = 0
+	exitFatal          = 1
+	exitPartialFailure = 3
+	exitInterrupted    = 4
+)
+
+// maxRecordedErrors limits how many errors are kept for the run summary.
+const maxRecordedErrors = 100
+
+// runOutput reports what a command did, either as plain text (the paths of
+// affected files) or as JSON events, one per line.
+type runOutput struct {
+	format   outputFormat
+	command  string
+	whatIf   bool
+	progress *progress.Reporter
+	start    time.Time
+	fatal    *atomic.Bool
+	hooks    hooks
+	// forgottenRuns and failedRuns count the runs removed from the archive
+	// history, which are not files.
+	forgottenRuns *atomic.Int64
+	failedRuns    *atomic.Int64
+
+	mutex  *sync.Mutex
+	errors []string
+	// fatalError is the first error that failed the command as a whole.
+	fatalError string
+}
+
+// setupOutput is the output of the command being set up, which reports fatal
+// errors of the setup in its summary.
+var setupOutput *runOutput
+
+type fileEvent struct {
+	Event  string `json:"event"`
+	Action string `json:"action"`
+	Path   string `json:"path"`
+	// Target is the local file written to, where it isn't found by the path,
+	// e.g. for 'get'.
+	Target     string `json:"target,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	Bytes      int64  `json:"bytes"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type runEvent struct {
+	Event  string `json:"event"`
+	Action string `json:"action"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type summaryEvent struct {
+	Event           string    `json:"event"`
+	Command         string    `json:"command"`
+	Status          string    `json:"status"`
+	ExitCode        int       `json:"exitCode"`
+	WhatIf          bool      `json:"whatIf"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationMs      int64     `json:"durationMs"`
+	DiscoveredFiles int64     `json:"discoveredFiles"`
+	DiscoveredBytes int64     `json:"discoveredBytes"`
+	QueuedFiles     int64     `json:"queuedFiles"`
+	QueuedBytes     int64     `json:"queuedBytes"`
+	DoneFiles       int64     `json:"doneFiles"`
+	DoneBytes       int64     `json:"doneBytes"`
+	FailedFiles     int64     `json:"failedFiles"`
+	FailedBytes     int64     `json:"failedBytes"`
+	ForgottenRuns   int64     `json:"forgottenRuns,omitempty"`
+	FailedRuns      int64     `json:"failedRuns,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+func parseOutputFormat(s string) outputFormat {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text":
+		return outputText
+	case "json":
+		return outputJSON
+	}
+
+	glog.Exitf("Unsupported output format '%s'; expected 'text' or 'json'.", s)
+	return outputText
+}
+
+// newRunOutput creates the output of the command, which also reports fatal
+// errors of the command's setup from then on.
+func newRunOutput(command string, args commonArguments) *runOutput {
+	setupOutput = &runOutput{
+		format:   parseOutputFormat(args.outputFormat),
+		command:  command,
+		whatIf:   args.whatIf,
+		progress: newProgressReporter(args),
+		start:    time.Now(),
+		fatal:    &atomic.Bool{},
+		mutex:    &sync.Mutex{},
+
+		forgottenRuns: &atomic.Int64{},
+		failedRuns:    &atomic.Int64{},
+	}
+
+	return setupOutput
+}
+
+// exit exits with the given message. In JSON output, the summary of the
+// command being set up, if any, reports the message first.
+func exit(message string) {
+	exitDepth(1, message)
+}
+
+// exitf is like exit, with the message formatted like fmt.Sprintf does.
+func exitf(format string, args ...any) {
+	exitDepth(1, fmt.Sprintf(format, args...))
+}
+
+// exitDepth is like exit, with depth determining the call frame to log.
+func exitDepth(depth int, message string) {
+	if nil != setupOutput && setupOutput.format == outputJSON {
+		setupOutput.Fatal(errors.New(message))
+		setupOutput.Summarize(false)
+	}
+
+	glog.ExitDepth(depth+1, message)
+}
+
+// withHooks makes the output run the given hooks for failed files and the
+// summary.
+func (o *runOutput) withHooks(hookArgs hookArguments, args commonArguments) *runOutput {
+	o.hooks = newHooks(hookArgs, o.command, args)
+	return o
+}
+
+// FileDone reports a file that was processed successfully.
+func (o *runOutput) FileDone(action, relPath string, bytes int64, duration time.Duration) {
+	o.FileDoneTo(action, relPath, "", bytes, duration)
+}
+
+// FileDoneTo reports a file that was processed successfully by writing it to
+// the given local target.
+func (o *runOutput) FileDoneTo(action, relPath, target string, bytes int64, duration time.Duration) {
+	o.progress.Tracker().Done(bytes)
+
+	status := "ok"
+	if o.whatIf {
+		status = "whatif"
+	}
+
+	o.print(relPath, fileEvent{
+		Event:      "file",
+		Action:     action,
+		Path:       relPath,
+		Target:     target,
+		Status:     status,
+		Bytes:      bytes,
+		DurationMs: duration.Milliseconds(),
+	})
+}
+
+// FileFailed reports a file that could not be processed.
+func (o *runOutput) FileFailed(action, relPath string, bytes int64, duration time.Duration, err error) {
+	o.progress.Tracker().Failed(bytes)
+	o.recordError(fmt.Sprintf("%s '%s': %v", action, relPath, err))
+
+	event := fileEvent{
+		Event:      "file",
+		Action:     action,
+		Path:       relPath,
+		Status:     "failed",
+		Error:      err.Error(),
+		Bytes:      bytes,
+		DurationMs: duration.Milliseconds(),
+	}
+	if o.format == outputJSON {
+		o.print("", event)
+	}
+	o.hooks.runFail(event)
+}
+
+// RunForgotten reports a run that was removed from the archive history, or
+// could not be removed if err is not nil.
+func (o *runOutput) RunForgotten(id string, err error) {
+	event := runEvent{
+		Event:  "run",
+		Action: "forget",
+		ID:     id,
+		Status: "ok",
+	}
+
+	if nil != err {
+		o.failedRuns.Add(1)
+		o.recordError(fmt.Sprintf("forget run '%s': %v", id, err))
+		event.Status = "failed"
+		event.Error = err.Error()
+	} else {
+		o.forgottenRuns.Add(1)
+		if o.whatIf {
+			event.Status = "whatif"
+		}
+	}
+
+	if nil == err || o.format == outputJSON {
+		o.print(id, event)
+	}
+}
+
+// Fatal records that the command failed as a whole, e.g. because the index
+// could not be uploaded.
+func (o *runOutput) Fatal(err error) {
+	o.fatal.Store(true)
+	o.recordError(err.Error())
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if "" == o.fatalError {
+		o.fatalError = err.Error()
+	}
+}
+
+// Errors returns the errors recorded so far.
+func (o *runOutput) Errors() []string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return append([]string{}, o.errors...)
+}
+
+func (o *runOutput) recordError(msg string) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if len(o.errors) < maxRecordedErrors {
+		o.errors = append(o.errors, msg)
+	}
+}
+
+// Summarize reports the summary of the run.
+func (o *runOutput) Summarize(interrupted bool) summaryEvent {
+	stats := o.progress.Tracker().Stats()
+	status, exitCode := "success", exitSuccess
+
+	if o.fatal.Load() {
+		status, exitCode = "fatal", exitFatal
+	} else if interrupted {
+		status, exitCode = "interrupted", exitInterrupted
+	} else if stats.FailedFiles > 0 || o.failedRuns.Load() > 0 {
+		status, exitCode = "partial", exitPartialFailure
+	}
+
+	summary := summaryEvent{
+		Event:           "summary",
+		Command:         o.command,
+		Status:          status,
+		ExitCode:        exitCode,
+		WhatIf:          o.whatIf,
+		Start:           o.start,
+		End:             o.start.Add(stats.Elapsed),
+		DurationMs:      stats.Elapsed.Milliseconds(),
+		DiscoveredFiles: stats.DiscoveredFiles,
+		DiscoveredBytes: stats.DiscoveredBytes,
+		QueuedFiles:     stats.QueuedFiles,
+		QueuedBytes:     stats.QueuedBytes,
+		DoneFiles:       stats.DoneFiles,
+		DoneBytes:       stats.DoneBytes,
+		FailedFiles:     stats.FailedFiles,
+		FailedBytes:     stats.FailedBytes,
+		ForgottenRuns:   o.forgottenRuns.Load(),
+		FailedRuns:      o.failedRuns.Load(),
+		Error:           o.fatalMessage(),
+	}
+
+	if o.format == outputJSON {
+		o.print("", summary)
+	} else {
+		glog.Infof("Command '%s' finished with status '%s' after %v: %d file(s) done, %d file(s) failed.",
+			o.command, status, stats.Elapsed.Round(time.Millisecond),
+			stats.DoneFiles, stats.FailedFiles)
+		if 0 != summary.ForgottenRuns || 0 != summary.FailedRuns {
+			glog.Infof("%d run(s) forgotten, %d run(s) failed.", summary.ForgottenRuns, summary.FailedRuns)
+		}
+	}
+
+	return summary
+}
+
+func (o *runOutput) fatalMessage() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.fatalError
+}
+
+func (o *runOutput) print(text string, event any) {
+	if o.format == outputText {
+		o.progress.Println(text)
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if nil != err {
+		glog.Errorf("Failed to marshal output event: %v", err)
+		return
+	}
+
+	o.progress.Println(string(data))
+}
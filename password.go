@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/howeyc/gopass"
+	"golang.org/x/term"
+)
+
+// readPassword reads the archive's password from the source selected by the
+// arguments, or prompts for it when none is selected. When the archive is new,
+// a prompted password needs to be confirmed, so a typo doesn't make the
+// archive inaccessible.
+func readPassword(args commonArguments, isNewArchive bool) string {
+	if countPasswordSources(args) > 1 {
+		exit("Only one of -password-env, -password-file, -password-cmd and -keyfile can be used.")
+	}
+
+	switch {
+	case "" != args.passwordEnv:
+		password, found := os.LookupEnv(args.passwordEnv)
+		if !found || "" == password {
+			exitf("The environment variable '%s' does not hold a password.", args.passwordEnv)
+		}
+		return password
+
+	case "" != args.passwordFile:
+		return strings.TrimRight(string(readSecretFile("password-file", args.passwordFile)), "\r\n")
+
+	case "" != args.passwordCmd:
+		return readPasswordFromCommand(args.passwordCmd)
+
+	case "" != args.keyFile:
+		// Key files hold random bytes, which are used as they are.
+		return string(readSecretFile("keyfile", args.keyFile))
+	}
+
+	password := promptPassword("Please enter your password: ")
+	if isNewArchive {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			glog.Info("The archive is new, so the password needs to be confirmed.")
+			if promptPassword("Please confirm your password: ") != password {
+				exit("The passwords do not match.")
+			}
+		} else {
+			glog.Warning("The archive is new, but the password is not confirmed because it is not read from a terminal; " +
+				"a wrong password would make the archive inaccessible.")
+		}
+	}
+
+	return password
+}
+
+// hasPasswordSource determines if the arguments select a source for the
+// password other than prompting for it.
+func hasPasswordSource(args commonArguments) bool {
+	return countPasswordSources(args) > 0
+}
+
+func countPasswordSources(args commonArguments) int {
+	sources := 0
+	for _, source := range []string{args.passwordEnv, args.passwordFile, args.passwordCmd, args.keyFile} {
+		if "" != source {
+			sources++
+		}
+	}
+
+	return sources
+}
+
+func promptPassword(prompt string) string {
+	data, err := gopass.GetPasswdPrompt(prompt, true, os.Stdin, os.Stderr)
+
+	if nil != err {
+		exitf("Failed to read password: %v", err)
+	}
+
+	return string(data)
+}
+
+// readSecretFile reads a file holding a secret, given with the flag of the
+// given name, making sure that nobody else can read it.
+func readSecretFile(flagName, path string) []byte {
+	path = os.ExpandEnv(path)
+	info, err := os.Stat(path)
+	if nil != err {
+		exitf("Failed to read the file given with -%s: %v", flagName, err)
+	}
+
+	// Windows doesn't have Unix permissions.
+	if "windows" != runtime.GOOS && info.Mode().Perm()&0077 != 0 {
+		exitf("The file '%s' given with -%s must not be accessible by others (mode %v); use 'chmod 600' to fix it.",
+			path, flagName, info.Mode().Perm())
+	}
+
+	data, err := os.ReadFile(path)
+	if nil != err {
+		exitf("Failed to read the file given with -%s: %v", flagName, err)
+	} else if len(data) == 0 {
+		exitf("The file '%s' given with -%s is empty.", path, flagName)
+	}
+
+	return data
+}
+
+// readPasswordFromCommand runs the given command through the shell, e.g.
+// 'pass show backup', and uses the first line of its output as the password.
+func readPasswordFromCommand(command string) string {
+	cmd := shellCommand(command)
+	// The command may need to interact with the user, e.g. to unlock a vault.
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if nil != err {
+		exitf("The password command failed: %v", err)
+	}
+
+	password, _, _ := bytes.Cut(output, []byte("\n"))
+	password = bytes.TrimRight(password, "\r")
+	if len(password) == 0 {
+		exit("The password command did not output a password.")
+	}
+
+	return string(password)
+}
@@ -0,0 +1,220 @@
+package progress
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/term"
+)
+
+// Mode defines how progress is reported.
+type Mode int
+
+const (
+	ModeNone Mode = iota
+	ModeLog
+	ModeBar
+)
+
+const (
+	barWidth       = 30
+	barRefreshRate = 200 * time.Millisecond
+)
+
+// Reporter periodically reports the progress of a Tracker, either as a live
+// progress bar on the terminal or as log lines.
+type Reporter struct {
+	tracker  *Tracker
+	mode     Mode
+	interval time.Duration
+
+	mutex      sync.Mutex
+	barVisible bool
+	stop       chan bool
+	stopOnce   *sync.Once
+	wg         *sync.WaitGroup
+}
+
+// ParseMode parses a progress mode: 'auto' picks a progress bar when stderr is
+// a terminal and log lines otherwise.
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "auto":
+		if term.IsTerminal(int(os.Stderr.Fd())) {
+			return ModeBar, nil
+		}
+		return ModeLog, nil
+	case "bar":
+		return ModeBar, nil
+	case "log":
+		return ModeLog, nil
+	case "none":
+		return ModeNone, nil
+	}
+
+	return ModeNone, fmt.Errorf("unsupported progress mode '%s'", s)
+}
+
+// NewReporter creates a new Reporter. The interval is used between log lines;
+// the progress bar is refreshed more often.
+func NewReporter(t *Tracker, mode Mode, interval time.Duration) *Reporter {
+	return &Reporter{
+		tracker:  t,
+		mode:     mode,
+		interval: interval,
+		stop:     make(chan bool),
+		stopOnce: &sync.Once{},
+		wg:       &sync.WaitGroup{},
+	}
+}
+
+// Tracker returns the Tracker whose progress is reported.
+func (r *Reporter) Tracker() *Tracker {
+	return r.tracker
+}
+
+// Start starts reporting progress in the background.
+func (r *Reporter) Start() {
+	if r.mode == ModeNone {
+		return
+	}
+
+	interval := r.interval
+	if r.mode == ModeBar {
+		interval = barRefreshRate
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.report()
+			}
+		}
+	}()
+}
+
+// Stop stops reporting progress and reports the final state. It is safe to
+// call Stop more than once.
+func (r *Reporter) Stop() {
+	if r.mode == ModeNone {
+		return
+	}
+
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.wg.Wait()
+
+		r.report()
+		if r.mode == ModeBar {
+			r.mutex.Lock()
+			fmt.Fprintln(os.Stderr)
+			r.barVisible = false
+			r.mutex.Unlock()
+		}
+	})
+}
+
+// Println prints to stdout without garbling the progress bar.
+func (r *Reporter) Println(a ...any) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.clearBar()
+	fmt.Println(a...)
+}
+
+func (r *Reporter) report() {
+	stats := r.tracker.Stats()
+
+	switch r.mode {
+	case ModeLog:
+		glog.Infof("Progress: %s", formatStats(stats))
+
+	case ModeBar:
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+
+		r.clearBar()
+		fmt.Fprintf(os.Stderr, "%s %s", formatBar(stats), formatStats(stats))
+		r.barVisible = true
+	}
+}
+
+// clearBar clears the progress bar; the caller must hold the mutex.
+func (r *Reporter) clearBar() {
+	if r.barVisible {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		r.barVisible = false
+	}
+}
+
+func formatBar(s Stats) string {
+	if !s.DiscoveryComplete {
+		return "[" + strings.Repeat("?", barWidth) + "]"
+	}
+
+	fraction := 1.0
+	if s.QueuedBytes > 0 {
+		fraction = float64(s.DoneBytes+s.FailedBytes) / float64(s.QueuedBytes)
+	} else if s.QueuedFiles > 0 {
+		fraction = float64(s.DoneFiles+s.FailedFiles) / float64(s.QueuedFiles)
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+
+	filled := int(fraction * barWidth)
+	return fmt.Sprintf("[%s%s] %3.0f%%", strings.Repeat("=", filled),
+		strings.Repeat(" ", barWidth-filled), fraction*100)
+}
+
+func formatStats(s Stats) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "%d/%d file(s)", s.DoneFiles+s.FailedFiles, s.QueuedFiles)
+	if s.QueuedBytes > 0 {
+		fmt.Fprintf(&sb, ", %s/%s", FormatBytes(s.DoneBytes+s.FailedBytes),
+			FormatBytes(s.QueuedBytes))
+	}
+	fmt.Fprintf(&sb, ", %s/s", FormatBytes(int64(s.Throughput())))
+
+	if eta, ok := s.ETA(); ok {
+		fmt.Fprintf(&sb, ", ETA %v", eta.Round(time.Second))
+	} else if !s.DiscoveryComplete {
+		fmt.Fprintf(&sb, ", %d file(s) discovered", s.DiscoveredFiles)
+	}
+
+	if s.FailedFiles > 0 {
+		fmt.Fprintf(&sb, ", %d failed", s.FailedFiles)
+	}
+
+	return sb.String()
+}
+
+// FormatBytes formats the given number of bytes for humans.
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,131 @@
+package progress
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Tracker tracks the progress of a command. It is safe for concurrent use.
+type Tracker struct {
+	start time.Time
+
+	discoveredFiles atomic.Int64
+	discoveredBytes atomic.Int64
+	queuedFiles     atomic.Int64
+	queuedBytes     atomic.Int64
+	doneFiles       atomic.Int64
+	doneBytes       atomic.Int64
+	failedFiles     atomic.Int64
+	failedBytes     atomic.Int64
+
+	discoveryComplete atomic.Bool
+}
+
+// Stats is a snapshot of the progress tracked by a Tracker.
+type Stats struct {
+	Elapsed time.Duration
+
+	DiscoveredFiles int64
+	DiscoveredBytes int64
+	QueuedFiles     int64
+	QueuedBytes     int64
+	DoneFiles       int64
+	DoneBytes       int64
+	FailedFiles     int64
+	FailedBytes     int64
+
+	DiscoveryComplete bool
+}
+
+// NewTracker creates a new Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{
+		start: time.Now(),
+	}
+}
+
+// Discovered tracks a file that was found, either locally or in the archive.
+func (t *Tracker) Discovered(bytes int64) {
+	t.discoveredFiles.Add(1)
+	t.discoveredBytes.Add(bytes)
+}
+
+// Queued tracks a file that was queued for processing.
+func (t *Tracker) Queued(bytes int64) {
+	t.queuedFiles.Add(1)
+	t.queuedBytes.Add(bytes)
+}
+
+// Done tracks a file that was processed successfully.
+func (t *Tracker) Done(bytes int64) {
+	t.doneFiles.Add(1)
+	t.doneBytes.Add(bytes)
+}
+
+// Failed tracks a file that could not be processed.
+func (t *Tracker) Failed(bytes int64) {
+	t.failedFiles.Add(1)
+	t.failedBytes.Add(bytes)
+}
+
+// DiscoveryComplete marks the end of discovery, i.e. no more files will be
+// queued.
+func (t *Tracker) DiscoveryComplete() {
+	t.discoveryComplete.Store(true)
+}
+
+// Stats returns a snapshot of the tracked progress.
+func (t *Tracker) Stats() Stats {
+	return Stats{
+		Elapsed: time.Since(t.start),
+
+		DiscoveredFiles: t.discoveredFiles.Load(),
+		DiscoveredBytes: t.discoveredBytes.Load(),
+		QueuedFiles:     t.queuedFiles.Load(),
+		QueuedBytes:     t.queuedBytes.Load(),
+		DoneFiles:       t.doneFiles.Load(),
+		DoneBytes:       t.doneBytes.Load(),
+		FailedFiles:     t.failedFiles.Load(),
+		FailedBytes:     t.failedBytes.Load(),
+
+		DiscoveryComplete: t.discoveryComplete.Load(),
+	}
+}
+
+// Throughput returns the average number of bytes processed per second.
+func (s Stats) Throughput() float64 {
+	seconds := s.Elapsed.Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+
+	return float64(s.DoneBytes+s.FailedBytes) / seconds
+}
+
+// ETA estimates the remaining time. It returns false when there is no
+// meaningful estimate yet.
+func (s Stats) ETA() (time.Duration, bool) {
+	if !s.DiscoveryComplete {
+		return 0, false
+	}
+
+	processedFiles := s.DoneFiles + s.FailedFiles
+	processedBytes := s.DoneBytes + s.FailedBytes
+	if processedFiles == 0 {
+		return 0, false
+	}
+
+	// Prefer an estimate based on bytes, but fall back to files when sizes
+	// are not known.
+	var ratio float64
+	if s.QueuedBytes > 0 && processedBytes > 0 {
+		ratio = float64(s.QueuedBytes-processedBytes) / float64(processedBytes)
+	} else {
+		ratio = float64(s.QueuedFiles-processedFiles) / float64(processedFiles)
+	}
+	if ratio < 0 {
+		ratio = 0
+	}
+
+	return time.Duration(ratio * float64(s.Elapsed)), true
+}
@@ -3,22 +3,47 @@
 package azureBlobs
 
 import (
+	"errors"
 	"io"
 	"sync"
+
+	"github.com/rokeller/bart/archiving"
 )
 
+// errUploadAborted is the error the upload of an aborted blob writer fails
+// with, so that the blob is not committed.
+var errUploadAborted = errors.New("the upload was aborted")
+
 type blobWriteCloser struct {
-	w  io.WriteCloser
-	wg *sync.WaitGroup
+	w       *io.PipeWriter
+	wg      *sync.WaitGroup
+	err     *error
+	version *archiving.Version
 }
 
-// Close implements io.WriteCloser.
+// Close implements io.WriteCloser. It waits for the upload to finish and
+// returns the upload's error, if any.
 func (w blobWriteCloser) Close() error {
 	err := w.w.Close()
 	w.wg.Wait()
+	if nil == err {
+		err = *w.err
+	}
 	return err
 }
 
+// Abort implements archiving.AbortableWriter. It fails the upload, so that the
+// blob is not committed.
+func (w blobWriteCloser) Abort() {
+	w.w.CloseWithError(errUploadAborted)
+	w.wg.Wait()
+}
+
+// Version implements archiving.VersionedWriteCloser.
+func (w blobWriteCloser) Version() archiving.Version {
+	return *w.version
+}
+
 // Write implements io.WriteCloser.
 func (w blobWriteCloser) Write(p []byte) (n int, err error) {
 	return w.w.Write(p)
@@ -0,0 +1,64 @@
+//go:build azure || azurite
+
+package azureBlobs
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/rokeller/bart/archiving"
+)
+
+// classifyError wraps errors for failures that are worth retrying in an
+// archiving.TransientError, including the delay asked for by the service.
+func classifyError(err error) error {
+	if nil == err {
+		return nil
+	}
+
+	var respErr *azcore.ResponseError
+	if !errors.As(err, &respErr) {
+		return err
+	}
+
+	switch respErr.StatusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return archiving.TransientError{
+			Err:        err,
+			RetryAfter: retryAfter(respErr.RawResponse),
+		}
+	}
+
+	return err
+}
+
+// retryAfter parses the Retry-After header of the given response, which holds
+// either a number of seconds or an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	if nil == resp {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if "" == value {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); nil == err {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if at, err := http.ParseTime(value); nil == err {
+		return time.Until(at)
+	}
+
+	return 0
+}
@@ -0,0 +1,203 @@
+//go:build azure || azurite
+
+package azureBlobs
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+const (
+	BLOBNAME_LOCK = "lock"
+
+	metadataOwner = "owner"
+
+	// leaseDuration is the duration of the lease on the lock blob, in seconds.
+	// The lease is renewed well before it expires, so it only runs out when
+	// its owner stops without releasing it.
+	leaseDuration = 60
+	leaseRenewal  = 20 * time.Second
+)
+
+type blobLock struct {
+	p       azureStorageProvider
+	lease   *lease.BlobClient
+	lost    *atomic.Pointer[error]
+	stop    chan bool
+	stopped chan bool
+}
+
+// AcquireLock implements archiving.StorageProvider.
+func (p azureStorageProvider) AcquireLock(owner string) (archiving.Lock, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	blobClient := p.client.NewBlockBlobClient(BLOBNAME_LOCK)
+	if err := p.ensureLockBlob(ctx, blobClient); nil != err {
+		return nil, classifyError(err)
+	}
+
+	leaseClient, err := lease.NewBlobClient(blobClient, nil)
+	if nil != err {
+		return nil, err
+	}
+
+	if _, err := leaseClient.AcquireLease(ctx, leaseDuration, nil); nil != err {
+		if bloberror.HasCode(err, bloberror.LeaseAlreadyPresent) {
+			return nil, archiving.LockedError{Owner: p.lockOwner(ctx)}
+		}
+
+		return nil, classifyError(err)
+	}
+
+	// Record the owner on the lock blob, so others can tell who holds it.
+	_, err = blobClient.SetMetadata(ctx, map[string]*string{metadataOwner: &owner},
+		&blob.SetMetadataOptions{
+			AccessConditions: &blob.AccessConditions{
+				LeaseAccessConditions: &blob.LeaseAccessConditions{
+					LeaseID: leaseClient.LeaseID(),
+				},
+			},
+		})
+	if nil != err {
+		glog.Warningf("Failed to record the owner of the archive lock: %v", err)
+	}
+
+	l := blobLock{
+		p:       p,
+		lease:   leaseClient,
+		lost:    &atomic.Pointer[error]{},
+		stop:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	go l.renew()
+
+	return l, nil
+}
+
+// BreakLock implements archiving.StorageProvider.
+func (p azureStorageProvider) BreakLock() error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	blobClient := p.client.NewBlockBlobClient(BLOBNAME_LOCK)
+	leaseClient, err := lease.NewBlobClient(blobClient, nil)
+	if nil != err {
+		return err
+	}
+
+	_, err = leaseClient.BreakLease(ctx, &lease.BlobBreakOptions{
+		BreakPeriod: to.Ptr(int32(0)),
+	})
+	if bloberror.HasCode(err, bloberror.BlobNotFound,
+		bloberror.LeaseNotPresentWithLeaseOperation) {
+		// There's no lock to break.
+		return nil
+	}
+
+	return classifyError(err)
+}
+
+// ensureLockBlob creates the lock blob unless it exists already.
+func (p azureStorageProvider) ensureLockBlob(
+	ctx context.Context,
+	blobClient *blockblob.Client,
+) error {
+	_, err := blobClient.Upload(ctx, streaming.NopCloser(strings.NewReader("")),
+		&blockblob.UploadOptions{
+			AccessConditions: &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{
+					IfNoneMatch: to.Ptr(azcore.ETagAny),
+				},
+			},
+		})
+
+	if bloberror.HasCode(err, bloberror.BlobAlreadyExists,
+		bloberror.ConditionNotMet, bloberror.LeaseIDMissing) {
+		return nil
+	}
+
+	return err
+}
+
+func (p azureStorageProvider) lockOwner(ctx context.Context) string {
+	props, err := p.client.NewBlobClient(BLOBNAME_LOCK).GetProperties(ctx, nil)
+	if nil != err {
+		return "an unknown owner"
+	}
+
+	for key, value := range props.Metadata {
+		if strings.EqualFold(key, metadataOwner) && nil != value {
+			return *value
+		}
+	}
+
+	return "an unknown owner"
+}
+
+// Release implements archiving.Lock.
+func (l blobLock) Release() error {
+	close(l.stop)
+	<-l.stopped
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.p.timeout)
+	defer cancel()
+
+	_, err := l.lease.ReleaseLease(ctx, nil)
+	return classifyError(err)
+}
+
+func (l blobLock) renew() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), l.p.timeout)
+			_, err := l.lease.RenewLease(ctx, nil)
+			cancel()
+			if nil == err {
+				renewed = time.Now()
+				continue
+			}
+
+			// Failed renewals are tried again until the lease expires, unless
+			// the lease is gone already.
+			if time.Since(renewed) >= leaseDuration*time.Second ||
+				bloberror.HasCode(err, bloberror.LeaseLost, bloberror.LeaseIDMismatchWithLeaseOperation,
+					bloberror.LeaseNotPresentWithLeaseOperation) {
+				glog.Errorf("Lost the archive lock: %v", err)
+				l.lost.Store(&err)
+				return
+			}
+			glog.Errorf("Failed to renew the archive lock: %v", err)
+		}
+	}
+}
+
+// Err implements archiving.Lock.
+func (l blobLock) Err() error {
+	if err := l.lost.Load(); nil != err {
+		return *err
+	}
+
+	return nil
+}
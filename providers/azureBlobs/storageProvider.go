@@ -4,15 +4,21 @@ package azureBlobs
 
 import (
 	"context"
+	"errors"
 	"io"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
@@ -20,38 +26,56 @@ import (
 )
 
 const (
-	BLOBNAME_SETTINGS = "settings"
-	BLOBNAME_INDEX    = "index"
+	BLOBNAME_SETTINGS      = "settings"
+	BLOBNAME_INDEX         = "index"
+	BLOBPREFIX_INDEX       = "index/"
+	BLOBPREFIX_RUN_RECORDS = "history/"
 )
 
 type azureStorageProvider struct {
-	client *container.Client
+	client  *container.Client
+	timeout time.Duration
 }
 
-func NewAzuriteStorageProvider(containerName string) archiving.StorageProvider {
+func NewAzuriteStorageProvider(containerName string, timeout time.Duration) archiving.StorageProvider {
 	connStr := "AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;DefaultEndpointsProtocol=http;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;QueueEndpoint=http://127.0.0.1:10001/devstoreaccount1;TableEndpoint=http://127.0.0.1:10002/devstoreaccount1;"
-	blobClient, _ := azblob.NewClientFromConnectionString(connStr, nil)
+	blobClient, _ := azblob.NewClientFromConnectionString(connStr, newClientOptions())
 
-	return newAzureStorageProvider(blobClient, containerName)
+	return newAzureStorageProvider(blobClient, containerName, timeout)
 }
 
 func NewAzureStorageProvider(
 	serviceURL string,
 	containerName string,
 	cred azcore.TokenCredential,
+	timeout time.Duration,
 ) archiving.StorageProvider {
-	blobClient, err := azblob.NewClient(serviceURL, cred, nil)
+	blobClient, err := azblob.NewClient(serviceURL, cred, newClientOptions())
 	if nil != err {
 		glog.Exitf("Failed to create Azure Blob client: %v", err)
 	}
 
-	return newAzureStorageProvider(blobClient, containerName)
+	return newAzureStorageProvider(blobClient, containerName, timeout)
 }
 
-func newAzureStorageProvider(blobClient *azblob.Client, containerName string) archiving.StorageProvider {
+func newClientOptions() *azblob.ClientOptions {
+	// Retries are handled by the provider-agnostic retrying.StorageProvider,
+	// so the SDK's own retry policy is turned off to not multiply attempts.
+	return &azblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{
+			Retry: policy.RetryOptions{MaxRetries: -1},
+		},
+	}
+}
+
+func newAzureStorageProvider(
+	blobClient *azblob.Client,
+	containerName string,
+	timeout time.Duration,
+) archiving.StorageProvider {
 	containerClient := blobClient.ServiceClient().NewContainerClient(containerName)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	_, err := containerClient.Create(ctx, nil)
@@ -62,7 +86,8 @@ func newAzureStorageProvider(blobClient *azblob.Client, containerName string) ar
 	}
 
 	return azureStorageProvider{
-		client: containerClient,
+		client:  containerClient,
+		timeout: timeout,
 	}
 }
 
@@ -70,7 +95,7 @@ func newAzureStorageProvider(blobClient *azblob.Client, containerName string) ar
 func (p azureStorageProvider) DeleteBackupFile(entry domain.Entry) error {
 	blobName := blobNameForEntry(entry)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
 	defer cancel()
 
 	if err := p.deleteBlob(blobName, ctx); nil != err {
@@ -78,23 +103,55 @@ func (p azureStorageProvider) DeleteBackupFile(entry domain.Entry) error {
 			return archiving.BackupFileNotFound
 		}
 
-		return err
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+// DeleteBackupFileByID implements archiving.StorageProvider.
+func (p azureStorageProvider) DeleteBackupFileByID(blobID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if err := p.deleteBlob(blobNameForID(blobID), ctx); nil != err {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return archiving.BackupFileNotFound
+		}
+
+		return classifyError(err)
 	}
 
 	return nil
 }
 
 // DeleteIndex implements archiving.StorageProvider.
-func (p azureStorageProvider) DeleteIndex() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+func (p azureStorageProvider) DeleteIndex(shard string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
 	defer cancel()
 
-	if err := p.deleteBlob(BLOBNAME_INDEX, ctx); nil != err {
+	if err := p.deleteBlob(blobNameForIndex(shard), ctx); nil != err {
 		if bloberror.HasCode(err, bloberror.BlobNotFound) {
 			return archiving.IndexNotFound
 		}
 
-		return err
+		return classifyError(err)
+	}
+
+	return nil
+}
+
+// DeleteRunRecord implements archiving.StorageProvider.
+func (p azureStorageProvider) DeleteRunRecord(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	if err := p.deleteBlob(BLOBPREFIX_RUN_RECORDS+id, ctx); nil != err {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return archiving.RunRecordNotFound
+		}
+
+		return classifyError(err)
 	}
 
 	return nil
@@ -102,7 +159,7 @@ func (p azureStorageProvider) DeleteIndex() error {
 
 // DeleteSettings implements archiving.StorageProvider.
 func (p azureStorageProvider) DeleteSettings() error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
 	defer cancel()
 
 	if err := p.deleteBlob(BLOBNAME_SETTINGS, ctx); nil != err {
@@ -110,15 +167,30 @@ func (p azureStorageProvider) DeleteSettings() error {
 			return archiving.SettingsNotFound
 		}
 
-		return err
+		return classifyError(err)
 	}
 
 	return nil
 }
 
 // NewIndexWriter implements archiving.StorageProvider.
-func (p azureStorageProvider) NewIndexWriter() (io.WriteCloser, error) {
-	return p.newBlobWriter(BLOBNAME_INDEX)
+func (p azureStorageProvider) NewIndexWriter(
+	shard string,
+	expected archiving.Version,
+) (archiving.VersionedWriteCloser, error) {
+	conditions := &blob.ModifiedAccessConditions{}
+	if "" == expected {
+		conditions.IfNoneMatch = to.Ptr(azcore.ETagAny)
+	} else {
+		conditions.IfMatch = to.Ptr(azcore.ETag(expected))
+	}
+
+	return p.newConditionalBlobWriter(blobNameForIndex(shard), conditions), nil
+}
+
+// NewRunRecordWriter implements archiving.StorageProvider.
+func (p azureStorageProvider) NewRunRecordWriter(id string) (io.WriteCloser, error) {
+	return p.newBlobWriter(BLOBPREFIX_RUN_RECORDS + id)
 }
 
 // NewSettingsWriter implements archiving.StorageProvider.
@@ -128,7 +200,12 @@ func (p azureStorageProvider) NewSettingsWriter() (io.WriteCloser, error) {
 
 // ReadBackupFile implements archiving.StorageProvider.
 func (p azureStorageProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser, error) {
-	blobName := blobNameForEntry(entry)
+	return p.ReadBackupFileByID(archiving.BlobID(entry))
+}
+
+// ReadBackupFileByID implements archiving.StorageProvider.
+func (p azureStorageProvider) ReadBackupFileByID(blobID string) (io.ReadCloser, error) {
+	blobName := blobNameForID(blobID)
 
 	// Not using a context with a timeout, since the file can be quite big and
 	// take a while to read.
@@ -138,31 +215,102 @@ func (p azureStorageProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser,
 			return nil, archiving.BackupFileNotFound
 		}
 
-		return nil, err
+		return nil, classifyError(err)
 	}
 
 	return r, nil
 }
 
 // ReadIndex implements archiving.StorageProvider.
-func (p azureStorageProvider) ReadIndex() (io.ReadCloser, error) {
+func (p azureStorageProvider) ReadIndex(shard string) (io.ReadCloser, archiving.Version, error) {
 	// Not using a context with a timeout, since the index can be quite big
 	// and take a while to read.
-	r, err := p.readBlob(BLOBNAME_INDEX, nil)
+	blobClient := p.client.NewBlobClient(blobNameForIndex(shard))
+	res, err := blobClient.DownloadStream(context.Background(), nil)
 	if nil != err {
 		if bloberror.HasCode(err, bloberror.BlobNotFound) {
-			return nil, archiving.IndexNotFound
+			return nil, "", archiving.IndexNotFound
 		}
 
-		return nil, err
+		return nil, "", classifyError(err)
+	}
+
+	return res.Body, archiving.Version(*res.ETag), nil
+}
+
+// ListBackupFiles implements archiving.StorageProvider.
+func (p azureStorageProvider) ListBackupFiles(fn func(archiving.BackupFileInfo) error) error {
+	var fnErr error
+	err := p.listBlobs("", func(item *container.BlobItem) {
+		if nil != fnErr {
+			return
+		}
+
+		// Backup files are named by their hash, prefixed by its first two
+		// bytes; everything else belongs to the archive itself.
+		blobID := path.Base(*item.Name)
+		if !domain.IsHash(blobID) || blobNameForID(blobID) != *item.Name {
+			return
+		}
+
+		fnErr = fn(archiving.BackupFileInfo{
+			BlobID:   blobID,
+			Size:     *item.Properties.ContentLength,
+			Modified: *item.Properties.LastModified,
+		})
+	})
+	if nil != err {
+		return classifyError(err)
+	}
+
+	return fnErr
+}
+
+// ListIndexShards implements archiving.StorageProvider.
+func (p azureStorageProvider) ListIndexShards() (map[string]archiving.Version, error) {
+	shards := make(map[string]archiving.Version)
+	err := p.listBlobs(BLOBNAME_INDEX, func(item *container.BlobItem) {
+		version := archiving.Version(*item.Properties.ETag)
+		if BLOBNAME_INDEX == *item.Name {
+			shards[archiving.LegacyIndexShard] = version
+		} else if strings.HasPrefix(*item.Name, BLOBPREFIX_INDEX) {
+			shards[strings.TrimPrefix(*item.Name, BLOBPREFIX_INDEX)] = version
+		}
+	})
+	if nil != err {
+		return nil, classifyError(err)
+	}
+
+	return shards, nil
+}
+
+// ReadRunRecord implements archiving.StorageProvider.
+func (p azureStorageProvider) ReadRunRecord(id string) (io.ReadCloser, error) {
+	r, err := p.readBlob(BLOBPREFIX_RUN_RECORDS+id, nil)
+	if nil != err {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil, archiving.RunRecordNotFound
+		}
+
+		return nil, classifyError(err)
 	}
 
 	return r, nil
 }
 
+// ListRunRecords implements archiving.StorageProvider.
+func (p azureStorageProvider) ListRunRecords() ([]string, error) {
+	ids := []string{}
+	err := p.listBlobs(BLOBPREFIX_RUN_RECORDS, func(item *container.BlobItem) {
+		ids = append(ids, strings.TrimPrefix(*item.Name, BLOBPREFIX_RUN_RECORDS))
+	})
+
+	return ids, classifyError(err)
+}
+
 // ReadSettings implements archiving.StorageProvider.
 func (p azureStorageProvider) ReadSettings() (io.ReadCloser, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
 	defer cancel()
 
 	r, err := p.readBlob(BLOBNAME_SETTINGS, ctx)
@@ -171,7 +319,7 @@ func (p azureStorageProvider) ReadSettings() (io.ReadCloser, error) {
 			return nil, archiving.SettingsNotFound
 		}
 
-		return nil, err
+		return nil, classifyError(err)
 	}
 
 	return r, nil
@@ -180,11 +328,20 @@ func (p azureStorageProvider) ReadSettings() (io.ReadCloser, error) {
 // WriteBackupFile implements archiving.StorageProvider.
 func (p azureStorageProvider) WriteBackupFile(
 	entry domain.Entry,
-	file *os.File,
+	r io.ReadSeeker,
 ) error {
 	blobName := blobNameForEntry(entry)
 
-	return p.uploadFile(blobName, file, nil)
+	// Files can be uploaded in parallel blocks; other readers (e.g. with a
+	// bandwidth limit) need to be streamed.
+	if file, ok := r.(*os.File); ok {
+		return classifyError(p.uploadFile(blobName, file, nil))
+	}
+
+	blobClient := p.client.NewBlockBlobClient(blobName)
+	_, err := blobClient.UploadStream(context.Background(), r, nil)
+
+	return classifyError(err)
 }
 
 func (p azureStorageProvider) deleteBlob(blobName string, ctx context.Context) error {
@@ -198,6 +355,27 @@ func (p azureStorageProvider) deleteBlob(blobName string, ctx context.Context) e
 	return err
 }
 
+func (p azureStorageProvider) listBlobs(prefix string, fn func(item *container.BlobItem)) error {
+	pager := p.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+
+	for pager.More() {
+		ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+		page, err := pager.NextPage(ctx)
+		cancel()
+		if nil != err {
+			return err
+		}
+
+		for _, item := range page.Segment.BlobItems {
+			fn(item)
+		}
+	}
+
+	return nil
+}
+
 func (p azureStorageProvider) readBlob(blobName string, ctx context.Context) (io.ReadCloser, error) {
 	if nil == ctx {
 		ctx = context.Background()
@@ -213,25 +391,50 @@ func (p azureStorageProvider) readBlob(blobName string, ctx context.Context) (io
 }
 
 func (p azureStorageProvider) newBlobWriter(blobName string) (io.WriteCloser, error) {
+	return p.newConditionalBlobWriter(blobName, nil), nil
+}
+
+// newConditionalBlobWriter creates a writer for the given blob, which only
+// replaces the blob when the given conditions are met.
+func (p azureStorageProvider) newConditionalBlobWriter(
+	blobName string,
+	conditions *blob.ModifiedAccessConditions,
+) blobWriteCloser {
 	r, w := io.Pipe()
 
 	wg := &sync.WaitGroup{}
-	bw := blobWriteCloser{w: w, wg: wg}
+	bw := blobWriteCloser{w: w, wg: wg, err: new(error), version: new(archiving.Version)}
 	wg.Add(1)
 
 	go func() {
 		defer wg.Done()
 		blobClient := p.client.NewBlockBlobClient(blobName)
-		_, err := blobClient.UploadStream(context.Background(), r, nil)
-
-		if nil != err {
+		res, err := blobClient.UploadStream(context.Background(), r,
+			&blockblob.UploadStreamOptions{
+				AccessConditions: &blob.AccessConditions{
+					ModifiedAccessConditions: conditions,
+				},
+			})
+
+		if errors.Is(err, errUploadAborted) {
+			glog.V(1).Infof("Aborted uploading '%s'.", blobName)
+			*bw.err = err
+		} else if nil != err {
 			glog.Errorf("Failed to upload '%s': %v", blobName, err)
+			if bloberror.HasCode(err, bloberror.ConditionNotMet, bloberror.BlobAlreadyExists) {
+				*bw.err = archiving.IndexConflict
+			} else {
+				*bw.err = classifyError(err)
+			}
+			// Unblock the writer in case the upload stopped reading early.
+			r.CloseWithError(err)
 		} else {
+			*bw.version = archiving.Version(*res.ETag)
 			glog.Infof("Finished uploading '%s'.", blobName)
 		}
 	}()
 
-	return bw, nil
+	return bw
 }
 
 func (p azureStorageProvider) uploadFile(
@@ -247,9 +450,18 @@ func (p azureStorageProvider) uploadFile(
 	return err
 }
 
+func blobNameForIndex(shard string) string {
+	if archiving.LegacyIndexShard == shard {
+		return BLOBNAME_INDEX
+	}
+
+	return BLOBPREFIX_INDEX + shard
+}
+
 func blobNameForEntry(entry domain.Entry) string {
-	hash := entry.Hash()
-	blobName := path.Join(hash[0:2], hash[2:4], hash)
+	return blobNameForID(archiving.BlobID(entry))
+}
 
-	return blobName
+func blobNameForID(blobID string) string {
+	return path.Join(blobID[0:2], blobID[2:4], blobID)
 }
@@ -0,0 +1,175 @@
+//go:build files
+
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/rokeller/bart/archiving"
+)
+
+const (
+	// writeLockTimeout is how long to wait for another writer of the same file.
+	writeLockTimeout = 30 * time.Second
+	// writeLockStaleAfter is the time after which a write lock is considered
+	// stale, since writers only hold it for a rename.
+	writeLockStaleAfter = time.Minute
+)
+
+// conditionalWriter writes to a temporary file first, and only replaces the
+// target file when it is closed and the target still has the expected version.
+type conditionalWriter struct {
+	*os.File
+	targetPath string
+	expected   archiving.Version
+	version    archiving.Version
+	closed     bool
+}
+
+func newConditionalWriter(
+	targetPath string,
+	expected archiving.Version,
+) (*conditionalWriter, error) {
+	tempFile, err := os.CreateTemp(path.Dir(targetPath), path.Base(targetPath)+".tmp-*")
+	if nil != err {
+		return nil, err
+	}
+
+	return &conditionalWriter{
+		File:       tempFile,
+		targetPath: targetPath,
+		expected:   expected,
+	}, nil
+}
+
+// Abort implements archiving.AbortableWriter. It discards the temporary file.
+func (w *conditionalWriter) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// Close implements io.WriteCloser.
+func (w *conditionalWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	defer os.Remove(w.File.Name())
+	if err := w.File.Close(); nil != err {
+		return err
+	}
+
+	if "" == w.expected {
+		return w.create()
+	}
+
+	return w.replace()
+}
+
+// create creates the target file, which must not exist yet. Linking the
+// temporary file fails when the target exists, so concurrent writers cannot
+// both succeed.
+func (w *conditionalWriter) create() error {
+	if err := os.Link(w.File.Name(), w.targetPath); errors.Is(err, os.ErrExist) {
+		return archiving.IndexConflict
+	} else if nil != err {
+		return err
+	}
+
+	var err error
+	w.version, err = fileVersion(w.targetPath)
+	return err
+}
+
+// replace replaces the target file if it still has the expected version. The
+// check and the replacement happen under a lock file, so that concurrent
+// writers cannot both pass the check.
+func (w *conditionalWriter) replace() error {
+	lockPath := w.targetPath + ".lock"
+	if err := acquireWriteLock(lockPath); nil != err {
+		return err
+	}
+	defer os.Remove(lockPath)
+
+	current, err := fileVersion(w.targetPath)
+	if nil != err {
+		return err
+	} else if current != w.expected {
+		return archiving.IndexConflict
+	}
+
+	if err := os.Rename(w.File.Name(), w.targetPath); nil != err {
+		return err
+	}
+
+	w.version, err = fileVersion(w.targetPath)
+	return err
+}
+
+// acquireWriteLock creates the given lock file, waiting while another writer
+// holds it. Lock files left behind by crashed writers are removed once they
+// are stale.
+func acquireWriteLock(lockPath string) error {
+	deadline := time.Now().Add(writeLockTimeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if nil == err {
+			return f.Close()
+		} else if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		if removeStaleLock(lockPath, writeLockStaleAfter) {
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for the write lock '%s'", lockPath)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Version implements archiving.VersionedWriteCloser.
+func (w *conditionalWriter) Version() archiving.Version {
+	return w.version
+}
+
+// fileVersion determines the version of the file at the given path, or the
+// empty version if the file does not exist.
+func fileVersion(filePath string) (archiving.Version, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if nil != err {
+		return "", err
+	}
+	defer file.Close()
+
+	return versionOf(file)
+}
+
+// versionOf determines the version of the content read from r. It is derived
+// from the content, since modification times are too coarse on some file
+// systems to tell two writes of the same size apart.
+func versionOf(r io.Reader) (archiving.Version, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); nil != err {
+		return "", err
+	}
+
+	return archiving.Version(hex.EncodeToString(hash.Sum(nil))), nil
+}
@@ -0,0 +1,91 @@
+//go:build files
+
+package files
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rokeller/bart/archiving"
+)
+
+func writeTestIndex(t *testing.T, p archiving.StorageProvider, expected archiving.Version, data string) (archiving.Version, error) {
+	t.Helper()
+
+	w, err := p.NewIndexWriter("shard", expected)
+	if nil != err {
+		t.Fatalf("creating the index writer failed: %v", err)
+	}
+	if _, err := io.WriteString(w, data); nil != err {
+		t.Fatalf("writing the index failed: %v", err)
+	}
+	if err := w.Close(); nil != err {
+		return "", err
+	}
+
+	return w.Version(), nil
+}
+
+// setModTime sets the modification time of the index shard, like a file system
+// with coarse modification times would, and returns the shard's version.
+func setModTime(t *testing.T, p fileStorageProvider, modTime time.Time) archiving.Version {
+	t.Helper()
+
+	if err := os.Chtimes(p.getIndexPath("shard"), modTime, modTime); nil != err {
+		t.Fatalf("setting the modification time failed: %v", err)
+	}
+
+	shards, err := p.ListIndexShards()
+	if nil != err {
+		t.Fatalf("listing the index shards failed: %v", err)
+	}
+
+	return shards["shard"]
+}
+
+func TestConditionalWriteSameSizeAndModTime(t *testing.T) {
+	p := fileStorageProvider{targetRoot: t.TempDir()}
+	modTime := time.Now().Truncate(2 * time.Second)
+
+	if _, err := writeTestIndex(t, p, "", "version A"); nil != err {
+		t.Fatalf("creating the index failed: %v", err)
+	}
+	first := setModTime(t, p, modTime)
+
+	// Someone else replaces the index with data of the same size.
+	if _, err := writeTestIndex(t, p, first, "version B"); nil != err {
+		t.Fatalf("replacing the index failed: %v", err)
+	}
+	second := setModTime(t, p, modTime)
+	if first == second {
+		t.Fatalf("both writes have the version '%s'", first)
+	}
+
+	// Replacing the index based on the first version must fail.
+	if _, err := writeTestIndex(t, p, first, "version C"); !errors.Is(err, archiving.IndexConflict) {
+		t.Errorf("got error %v, want %v", err, archiving.IndexConflict)
+	}
+
+	r, version, err := p.ReadIndex("shard")
+	if nil != err {
+		t.Fatalf("reading the index failed: %v", err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); "version B" != string(data) || second != version {
+		t.Errorf("read '%s' with version '%s', want 'version B' with version '%s'", data, version, second)
+	}
+}
+
+func TestConditionalCreateConflict(t *testing.T) {
+	p := fileStorageProvider{targetRoot: t.TempDir()}
+
+	if _, err := writeTestIndex(t, p, "", "version A"); nil != err {
+		t.Fatalf("creating the index failed: %v", err)
+	}
+	if _, err := writeTestIndex(t, p, "", "version B"); !errors.Is(err, archiving.IndexConflict) {
+		t.Errorf("got error %v, want %v", err, archiving.IndexConflict)
+	}
+}
@@ -0,0 +1,201 @@
+//go:build files
+
+package files
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+const (
+	FILENAME_LOCK = ".lock"
+
+	// lockHeartbeat is the interval at which the lock file's modification time
+	// is updated while the lock is held.
+	lockHeartbeat = time.Minute
+	// lockStaleAfter is the time after which a lock file without heartbeat is
+	// considered stale, e.g. because its owner crashed.
+	lockStaleAfter = 10 * time.Minute
+)
+
+type fileLock struct {
+	lockPath string
+	// file is the lock file created, to tell it from lock files created by
+	// others after it was taken over.
+	file    os.FileInfo
+	lost    *atomic.Pointer[error]
+	stop    chan bool
+	stopped chan bool
+}
+
+// AcquireLock implements archiving.StorageProvider.
+func (p fileStorageProvider) AcquireLock(owner string) (archiving.Lock, error) {
+	lockPath := path.Join(p.targetRoot, FILENAME_LOCK)
+
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		if removeStaleLock(lockPath, lockStaleAfter) {
+			file, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		}
+	}
+	if errors.Is(err, os.ErrExist) {
+		holder, _ := os.ReadFile(lockPath)
+		return nil, archiving.LockedError{Owner: string(holder)}
+	} else if nil != err {
+		return nil, err
+	}
+
+	_, err = file.WriteString(owner)
+	if closeErr := file.Close(); nil == err {
+		err = closeErr
+	}
+	var info os.FileInfo
+	if nil == err {
+		info, err = os.Stat(lockPath)
+	}
+	if nil != err {
+		os.Remove(lockPath)
+		return nil, err
+	}
+
+	l := fileLock{
+		lockPath: lockPath,
+		file:     info,
+		lost:     &atomic.Pointer[error]{},
+		stop:     make(chan bool),
+		stopped:  make(chan bool),
+	}
+	go l.heartbeat()
+
+	return l, nil
+}
+
+// BreakLock implements archiving.StorageProvider.
+func (p fileStorageProvider) BreakLock() error {
+	lockPath := path.Join(p.targetRoot, FILENAME_LOCK)
+	if err := os.Remove(lockPath); nil != err && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// removeStaleLock removes the lock file at the given path if it has not been
+// updated for longer than staleAfter, and returns true if the lock can be
+// acquired again. Other processes may take over the same stale lock, so it is
+// moved aside atomically first, and only removed if it is still the lock file
+// that was found stale; otherwise it is put back.
+func removeStaleLock(lockPath string, staleAfter time.Duration) bool {
+	info, err := os.Stat(lockPath)
+	if os.IsNotExist(err) {
+		// The lock has been released in the meantime.
+		return true
+	} else if nil != err {
+		return false
+	}
+
+	age := time.Since(info.ModTime())
+	if age <= staleAfter {
+		return false
+	}
+
+	stalePath := fmt.Sprintf("%s.stale-%d-%d", lockPath, os.Getpid(), rand.Uint64())
+	if err := os.Rename(lockPath, stalePath); nil != err {
+		// Another process took the stale lock over, or it was released.
+		return os.IsNotExist(err)
+	}
+	defer os.Remove(stalePath)
+
+	moved, err := os.Stat(stalePath)
+	if nil == err && os.SameFile(info, moved) && moved.ModTime().Equal(info.ModTime()) {
+		glog.Warningf("Removed stale lock '%s', last updated %v ago.", lockPath, age.Round(time.Second))
+		return true
+	}
+
+	// The lock was taken over, or updated by its owner, after it was found
+	// stale; it must not be removed.
+	if err := os.Link(stalePath, lockPath); nil != err {
+		glog.Errorf("Failed to put back the lock '%s': %v", lockPath, err)
+	}
+
+	return false
+}
+
+// Release implements archiving.Lock.
+func (l fileLock) Release() error {
+	close(l.stop)
+	<-l.stopped
+
+	if nil != l.Err() {
+		// The lock file may belong to someone else by now.
+		return nil
+	}
+
+	return os.Remove(l.lockPath)
+}
+
+// Err implements archiving.Lock.
+func (l fileLock) Err() error {
+	if err := l.lost.Load(); nil != err {
+		return *err
+	}
+
+	return nil
+}
+
+// heartbeat updates the lock file's modification time while the lock is held.
+// The lock is lost when the lock file was removed or taken over, or when it
+// could not be updated before it became stale.
+func (l fileLock) heartbeat() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(lockHeartbeat)
+	defer ticker.Stop()
+
+	updated := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			err := l.touch()
+			if nil == err {
+				updated = time.Now()
+				continue
+			}
+
+			if errors.Is(err, errLockTakenOver) || time.Since(updated) > lockStaleAfter {
+				glog.Errorf("Lost the archive lock: %v", err)
+				l.lost.Store(&err)
+				return
+			}
+			glog.Errorf("Failed to update archive lock: %v", err)
+		}
+	}
+}
+
+// errLockTakenOver is the error for a lock file that was removed or replaced by
+// someone else.
+var errLockTakenOver = errors.New("the lock file was removed or taken over")
+
+// touch updates the modification time of the lock file, unless it is not the
+// lock file created anymore.
+func (l fileLock) touch() error {
+	info, err := os.Stat(l.lockPath)
+	if os.IsNotExist(err) || (nil == err && !os.SameFile(info, l.file)) {
+		return errLockTakenOver
+	} else if nil != err {
+		return err
+	}
+
+	now := time.Now()
+	return os.Chtimes(l.lockPath, now, now)
+}
@@ -3,9 +3,12 @@
 package files
 
 import (
+	"bytes"
+	"encoding/hex"
 	"io"
 	"os"
 	"path"
+	"strings"
 
 	"github.com/golang/glog"
 	"github.com/rokeller/bart/archiving"
@@ -15,6 +18,8 @@ import (
 const (
 	FILENAME_SETTINGS = ".settings"
 	FILENAME_INDEX    = ".index.gz.encrypted"
+	DIRNAME_INDEX     = ".index"
+	DIRNAME_HISTORY   = ".history"
 )
 
 type fileStorageProvider struct {
@@ -31,7 +36,12 @@ func NewFileStorageProvider(targetRoot string) archiving.StorageProvider {
 
 // DeleteBackupFile implements archiving.StorageProvider.
 func (p fileStorageProvider) DeleteBackupFile(entry domain.Entry) error {
-	archiveRelPath := p.getArchiveRelPath(entry)
+	return p.DeleteBackupFileByID(archiving.BlobID(entry))
+}
+
+// DeleteBackupFileByID implements archiving.StorageProvider.
+func (p fileStorageProvider) DeleteBackupFileByID(blobID string) error {
+	archiveRelPath := p.getArchiveRelPathForID(blobID)
 	archiveFullPath := path.Join(p.targetRoot, archiveRelPath)
 
 	if err := os.Remove(archiveFullPath); nil != err {
@@ -55,8 +65,8 @@ func (p fileStorageProvider) DeleteBackupFile(entry domain.Entry) error {
 }
 
 // DeleteIndex implements archiving.StorageProvider.
-func (p fileStorageProvider) DeleteIndex() error {
-	targetPath := path.Join(p.targetRoot, FILENAME_INDEX)
+func (p fileStorageProvider) DeleteIndex(shard string) error {
+	targetPath := p.getIndexPath(shard)
 	if err := os.Remove(targetPath); nil != err {
 		if os.IsNotExist(err) {
 			return archiving.IndexNotFound
@@ -68,6 +78,20 @@ func (p fileStorageProvider) DeleteIndex() error {
 	return nil
 }
 
+// DeleteRunRecord implements archiving.StorageProvider.
+func (p fileStorageProvider) DeleteRunRecord(id string) error {
+	targetPath := path.Join(p.targetRoot, DIRNAME_HISTORY, id)
+	if err := os.Remove(targetPath); nil != err {
+		if os.IsNotExist(err) {
+			return archiving.RunRecordNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
 // DeleteSettings implements archiving.StorageProvider.
 func (p fileStorageProvider) DeleteSettings() error {
 	targetPath := path.Join(p.targetRoot, FILENAME_SETTINGS)
@@ -83,9 +107,31 @@ func (p fileStorageProvider) DeleteSettings() error {
 }
 
 // NewIndexWriter implements archiving.StorageProvider.
-func (p fileStorageProvider) NewIndexWriter() (io.WriteCloser, error) {
-	targetPath := path.Join(p.targetRoot, FILENAME_INDEX)
-	return os.Create(targetPath)
+func (p fileStorageProvider) NewIndexWriter(
+	shard string,
+	expected archiving.Version,
+) (archiving.VersionedWriteCloser, error) {
+	targetPath := p.getIndexPath(shard)
+	if err := os.MkdirAll(path.Dir(targetPath), 0700); nil != err {
+		return nil, err
+	}
+
+	w, err := newConditionalWriter(targetPath, expected)
+	if nil != err {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// NewRunRecordWriter implements archiving.StorageProvider.
+func (p fileStorageProvider) NewRunRecordWriter(id string) (io.WriteCloser, error) {
+	historyDir := path.Join(p.targetRoot, DIRNAME_HISTORY)
+	if err := os.MkdirAll(historyDir, 0700); nil != err {
+		return nil, err
+	}
+
+	return os.Create(path.Join(historyDir, id))
 }
 
 // NewSettingsWriter implements archiving.StorageProvider.
@@ -96,7 +142,12 @@ func (p fileStorageProvider) NewSettingsWriter() (io.WriteCloser, error) {
 
 // ReadBackupFile implements archiving.StorageProvider.
 func (p fileStorageProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser, error) {
-	archiveRelPath := p.getArchiveRelPath(entry)
+	return p.ReadBackupFileByID(archiving.BlobID(entry))
+}
+
+// ReadBackupFileByID implements archiving.StorageProvider.
+func (p fileStorageProvider) ReadBackupFileByID(blobID string) (io.ReadCloser, error) {
+	archiveRelPath := p.getArchiveRelPathForID(blobID)
 	archiveFullPath := path.Join(p.targetRoot, archiveRelPath)
 
 	file, err := os.Open(archiveFullPath)
@@ -110,10 +161,126 @@ func (p fileStorageProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser,
 }
 
 // ReadIndex implements archiving.StorageProvider.
-func (p fileStorageProvider) ReadIndex() (io.ReadCloser, error) {
-	file, err := p.readFile(FILENAME_INDEX)
+func (p fileStorageProvider) ReadIndex(shard string) (io.ReadCloser, archiving.Version, error) {
+	file, err := os.Open(p.getIndexPath(shard))
 	if os.IsNotExist(err) {
-		return nil, archiving.IndexNotFound
+		return nil, "", archiving.IndexNotFound
+	} else if nil != err {
+		return nil, "", err
+	}
+
+	// Determine the version from the content read, in case the file is
+	// replaced meanwhile.
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if nil != err {
+		return nil, "", err
+	}
+	version, err := versionOf(bytes.NewReader(data))
+	if nil != err {
+		return nil, "", err
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), version, nil
+}
+
+// ListIndexShards implements archiving.StorageProvider.
+func (p fileStorageProvider) ListIndexShards() (map[string]archiving.Version, error) {
+	shards := make(map[string]archiving.Version)
+
+	if version, err := fileVersion(p.getIndexPath(archiving.LegacyIndexShard)); nil != err {
+		return nil, err
+	} else if "" != version {
+		shards[archiving.LegacyIndexShard] = version
+	}
+
+	entries, err := os.ReadDir(path.Join(p.targetRoot, DIRNAME_INDEX))
+	if os.IsNotExist(err) {
+		return shards, nil
+	} else if nil != err {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		// Skip temporary files of index shards being written.
+		if entry.IsDir() || strings.Contains(entry.Name(), ".") {
+			continue
+		}
+
+		version, err := fileVersion(p.getIndexPath(entry.Name()))
+		if nil != err {
+			return nil, err
+		} else if "" != version {
+			// Files removed meanwhile are skipped.
+			shards[entry.Name()] = version
+		}
+	}
+
+	return shards, nil
+}
+
+// ListBackupFiles implements archiving.StorageProvider.
+func (p fileStorageProvider) ListBackupFiles(fn func(archiving.BackupFileInfo) error) error {
+	// Backup files are stored in two levels of directories named by the first
+	// two bytes of their hash; everything else belongs to the archive itself.
+	return p.walkHashDirs(p.targetRoot, 2, func(dir string) error {
+		entries, err := os.ReadDir(dir)
+		if nil != err {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !domain.IsHash(entry.Name()) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if nil != err {
+				return err
+			}
+
+			err = fn(archiving.BackupFileInfo{
+				BlobID:   entry.Name(),
+				Size:     info.Size(),
+				Modified: info.ModTime(),
+			})
+			if nil != err {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// walkHashDirs calls fn for all directories the given number of levels below
+// dir, following only directories named like a hash byte (e.g. 'a3').
+func (p fileStorageProvider) walkHashDirs(dir string, levels int, fn func(string) error) error {
+	if 0 == levels {
+		return fn(dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if nil != err {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && isHashByte(entry.Name()) {
+			if err := p.walkHashDirs(path.Join(dir, entry.Name()), levels-1, fn); nil != err {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ReadRunRecord implements archiving.StorageProvider.
+func (p fileStorageProvider) ReadRunRecord(id string) (io.ReadCloser, error) {
+	file, err := p.readFile(path.Join(DIRNAME_HISTORY, id))
+	if os.IsNotExist(err) {
+		return nil, archiving.RunRecordNotFound
 	} else if nil != err {
 		return nil, err
 	}
@@ -121,6 +288,25 @@ func (p fileStorageProvider) ReadIndex() (io.ReadCloser, error) {
 	return file, nil
 }
 
+// ListRunRecords implements archiving.StorageProvider.
+func (p fileStorageProvider) ListRunRecords() ([]string, error) {
+	entries, err := os.ReadDir(path.Join(p.targetRoot, DIRNAME_HISTORY))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if nil != err {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	return ids, nil
+}
+
 // ReadSettings implements archiving.StorageProvider.
 func (p fileStorageProvider) ReadSettings() (io.ReadCloser, error) {
 	file, err := p.readFile(FILENAME_SETTINGS)
@@ -134,7 +320,7 @@ func (p fileStorageProvider) ReadSettings() (io.ReadCloser, error) {
 }
 
 // WriteBackupFile implements archiving.StorageProvider.
-func (p fileStorageProvider) WriteBackupFile(entry domain.Entry, file *os.File) error {
+func (p fileStorageProvider) WriteBackupFile(entry domain.Entry, r io.ReadSeeker) error {
 	archiveRelPath := p.getArchiveRelPath(entry)
 	archiveFullPath := path.Join(p.targetRoot, archiveRelPath)
 	archiveFullDir := path.Dir(archiveFullPath)
@@ -149,15 +335,33 @@ func (p fileStorageProvider) WriteBackupFile(entry domain.Entry, file *os.File)
 	}
 	defer targetFile.Close()
 
-	_, err = io.Copy(targetFile, file)
+	_, err = io.Copy(targetFile, r)
 	return err
 }
 
 func (p fileStorageProvider) getArchiveRelPath(entry domain.Entry) string {
-	hash := entry.Hash()
-	archiveRelPath := path.Join(hash[0:2], hash[2:4], hash)
+	return p.getArchiveRelPathForID(archiving.BlobID(entry))
+}
+
+func (p fileStorageProvider) getArchiveRelPathForID(blobID string) string {
+	return path.Join(blobID[0:2], blobID[2:4], blobID)
+}
+
+func isHashByte(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(name)
+	return nil == err
+}
+
+func (p fileStorageProvider) getIndexPath(shard string) string {
+	if archiving.LegacyIndexShard == shard {
+		return path.Join(p.targetRoot, FILENAME_INDEX)
+	}
 
-	return archiveRelPath
+	return path.Join(p.targetRoot, DIRNAME_INDEX, shard)
 }
 
 func (p fileStorageProvider) readFile(relPath string) (io.ReadCloser, error) {
@@ -0,0 +1,77 @@
+//go:build files
+
+package files
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/domain"
+)
+
+func readBackupFile(t *testing.T, p fileStorageProvider, entry domain.Entry) string {
+	t.Helper()
+
+	r, err := p.ReadBackupFile(entry)
+	if nil != err {
+		t.Fatalf("reading the backup file failed: %v", err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if nil != err {
+		t.Fatalf("reading the backup file failed: %v", err)
+	}
+
+	return string(data)
+}
+
+func TestBackupFileAddressedByBlobID(t *testing.T) {
+	p := fileStorageProvider{targetRoot: t.TempDir()}
+	other := domain.Entry{RelPath: "other"}
+	entry := domain.Entry{
+		RelPath:       "file",
+		EntryMetadata: domain.EntryMetadata{BlobID: other.Hash()},
+	}
+
+	if err := p.WriteBackupFile(entry, strings.NewReader("content")); nil != err {
+		t.Fatalf("writing the backup file failed: %v", err)
+	}
+
+	if data := readBackupFile(t, p, entry); "content" != data {
+		t.Errorf("got '%s', want 'content'", data)
+	}
+	if _, err := p.ReadBackupFileByID(entry.BlobID); nil != err {
+		t.Errorf("reading the backup file by its ID failed: %v", err)
+	}
+	if _, err := p.ReadBackupFileByID(entry.Hash()); !errors.Is(err, archiving.BackupFileNotFound) {
+		t.Errorf("reading by the hash got error %v, want %v", err, archiving.BackupFileNotFound)
+	}
+
+	if err := p.DeleteBackupFile(entry); nil != err {
+		t.Errorf("deleting the backup file failed: %v", err)
+	}
+	if _, err := p.ReadBackupFile(entry); !errors.Is(err, archiving.BackupFileNotFound) {
+		t.Errorf("got error %v, want %v", err, archiving.BackupFileNotFound)
+	}
+}
+
+func TestBackupFileWithoutBlobID(t *testing.T) {
+	// Entries backed up by earlier versions are addressed by their hash.
+	p := fileStorageProvider{targetRoot: t.TempDir()}
+	entry := domain.Entry{RelPath: "file"}
+
+	if err := p.WriteBackupFile(entry, strings.NewReader("content")); nil != err {
+		t.Fatalf("writing the backup file failed: %v", err)
+	}
+
+	if _, err := p.ReadBackupFileByID(entry.Hash()); nil != err {
+		t.Errorf("reading the backup file by the hash failed: %v", err)
+	}
+	if data := readBackupFile(t, p, entry); "content" != data {
+		t.Errorf("got '%s', want 'content'", data)
+	}
+}
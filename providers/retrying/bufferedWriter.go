@@ -0,0 +1,139 @@
+package retrying
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+)
+
+// bufferedWriter buffers data in a temporary file, so it can be written to the
+// backup destination again when an attempt fails.
+type bufferedWriter struct {
+	p         retryingStorageProvider
+	operation string
+	newWriter func() (io.WriteCloser, error)
+	// readBack reads the object written, if it can be written conditionally,
+	// to tell if a failed attempt wrote it after all.
+	readBack func() (io.ReadCloser, archiving.Version, error)
+	f        *os.File
+	closed   bool
+	version  archiving.Version
+}
+
+func (p retryingStorageProvider) newBufferedWriter(
+	operation string,
+	newWriter func() (io.WriteCloser, error),
+) (*bufferedWriter, error) {
+	tempFile, err := os.CreateTemp(os.TempDir(), "bart-*")
+	if nil != err {
+		glog.Errorf("Failed to create temp file: %v", err)
+		return nil, err
+	}
+
+	return &bufferedWriter{
+		p:         p,
+		operation: operation,
+		newWriter: newWriter,
+		f:         tempFile,
+	}, nil
+}
+
+// Version implements archiving.VersionedWriteCloser. It returns the version of
+// the written data if the underlying writer reports one.
+func (w *bufferedWriter) Version() archiving.Version {
+	return w.version
+}
+
+// Write implements io.WriteCloser.
+func (w *bufferedWriter) Write(p []byte) (n int, err error) {
+	return w.f.Write(p)
+}
+
+// Abort implements archiving.AbortableWriter. It discards the buffered data.
+func (w *bufferedWriter) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
+
+// writtenBefore determines if the object in the backup destination holds the
+// buffered data, and records its version if so.
+func (w *bufferedWriter) writtenBefore() bool {
+	if nil == w.readBack {
+		return false
+	}
+
+	r, version, err := w.readBack()
+	if nil != err {
+		return false
+	}
+	defer r.Close()
+
+	if _, err := w.f.Seek(0, io.SeekStart); nil != err {
+		return false
+	}
+	written, err := io.ReadAll(r)
+	if nil != err {
+		return false
+	}
+	buffered, err := io.ReadAll(w.f)
+	if nil != err || !bytes.Equal(written, buffered) {
+		return false
+	}
+
+	w.version = version
+	return true
+}
+
+// Close implements io.WriteCloser. It uploads the buffered data.
+func (w *bufferedWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	defer os.Remove(w.f.Name())
+	defer w.f.Close()
+
+	failed := false
+	return w.p.retry(w.operation, func() error {
+		if _, err := w.f.Seek(0, io.SeekStart); nil != err {
+			return err
+		}
+
+		target, err := w.newWriter()
+		if nil != err {
+			failed = true
+			return err
+		}
+
+		if _, err := io.Copy(target, w.f); nil != err {
+			archiving.Abort(target)
+			failed = true
+			return err
+		}
+
+		if err := target.Close(); nil != err {
+			if failed && errors.Is(err, archiving.IndexConflict) && w.writtenBefore() {
+				glog.Warningf("A failed attempt to %s succeeded after all.", w.operation)
+				return nil
+			}
+			failed = true
+			return err
+		}
+
+		if versioned, ok := target.(archiving.VersionedWriteCloser); ok {
+			w.version = versioned.Version()
+		}
+
+		return nil
+	})
+}
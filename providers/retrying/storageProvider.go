@@ -0,0 +1,327 @@
+package retrying
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/domain"
+)
+
+// Options defines how failed storage operations are retried.
+type Options struct {
+	// Attempts is the maximum number of attempts for each operation.
+	Attempts int
+	// InitialDelay is the delay before the first retry. It is doubled for
+	// every subsequent retry.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two attempts, unless the backup
+	// destination explicitly asks for a longer delay.
+	MaxDelay time.Duration
+	// Stop is closed to stop waiting for retries, e.g. when the process is
+	// interrupted; operations are not retried anymore then.
+	Stop <-chan struct{}
+}
+
+type retryingStorageProvider struct {
+	inner   archiving.StorageProvider
+	options Options
+}
+
+// NewRetryingStorageProvider creates a storage provider that retries transient
+// failures of the given provider with exponential backoff.
+func NewRetryingStorageProvider(
+	inner archiving.StorageProvider,
+	options Options,
+) archiving.StorageProvider {
+	if options.Attempts < 1 {
+		options.Attempts = 1
+	}
+
+	return retryingStorageProvider{
+		inner:   inner,
+		options: options,
+	}
+}
+
+// DeleteBackupFile implements archiving.StorageProvider.
+func (p retryingStorageProvider) DeleteBackupFile(entry domain.Entry) error {
+	return p.retry("delete backup file", func() error {
+		return p.inner.DeleteBackupFile(entry)
+	})
+}
+
+// DeleteBackupFileByID implements archiving.StorageProvider.
+func (p retryingStorageProvider) DeleteBackupFileByID(blobID string) error {
+	return p.retry("delete backup file", func() error {
+		return p.inner.DeleteBackupFileByID(blobID)
+	})
+}
+
+// DeleteIndex implements archiving.StorageProvider.
+func (p retryingStorageProvider) DeleteIndex(shard string) error {
+	return p.retry("delete index", func() error {
+		return p.inner.DeleteIndex(shard)
+	})
+}
+
+// DeleteRunRecord implements archiving.StorageProvider.
+func (p retryingStorageProvider) DeleteRunRecord(id string) error {
+	return p.retry("delete run record", func() error {
+		return p.inner.DeleteRunRecord(id)
+	})
+}
+
+// DeleteSettings implements archiving.StorageProvider.
+func (p retryingStorageProvider) DeleteSettings() error {
+	return p.retry("delete settings", p.inner.DeleteSettings)
+}
+
+// NewIndexWriter implements archiving.StorageProvider.
+func (p retryingStorageProvider) NewIndexWriter(
+	shard string,
+	expected archiving.Version,
+) (archiving.VersionedWriteCloser, error) {
+	w, err := p.newBufferedWriter("write index", func() (io.WriteCloser, error) {
+		return p.inner.NewIndexWriter(shard, expected)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	// A conflict after a failed attempt may be caused by the attempt itself,
+	// when it was written but its reply was lost.
+	w.readBack = func() (io.ReadCloser, archiving.Version, error) {
+		return p.inner.ReadIndex(shard)
+	}
+
+	return w, nil
+}
+
+// NewRunRecordWriter implements archiving.StorageProvider.
+func (p retryingStorageProvider) NewRunRecordWriter(id string) (io.WriteCloser, error) {
+	w, err := p.newBufferedWriter("write run record", func() (io.WriteCloser, error) {
+		return p.inner.NewRunRecordWriter(id)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// NewSettingsWriter implements archiving.StorageProvider.
+func (p retryingStorageProvider) NewSettingsWriter() (io.WriteCloser, error) {
+	w, err := p.newBufferedWriter("write settings", p.inner.NewSettingsWriter)
+	if nil != err {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// ReadBackupFile implements archiving.StorageProvider.
+func (p retryingStorageProvider) ReadBackupFile(entry domain.Entry) (io.ReadCloser, error) {
+	return p.retryRead("read backup file", func() (io.ReadCloser, error) {
+		return p.inner.ReadBackupFile(entry)
+	})
+}
+
+// ReadBackupFileByID implements archiving.StorageProvider.
+func (p retryingStorageProvider) ReadBackupFileByID(blobID string) (io.ReadCloser, error) {
+	return p.retryRead("read backup file", func() (io.ReadCloser, error) {
+		return p.inner.ReadBackupFileByID(blobID)
+	})
+}
+
+// ReadIndex implements archiving.StorageProvider.
+func (p retryingStorageProvider) ReadIndex(shard string) (io.ReadCloser, archiving.Version, error) {
+	var r io.ReadCloser
+	var version archiving.Version
+	err := p.retry("read index", func() error {
+		var err error
+		r, version, err = p.inner.ReadIndex(shard)
+		return err
+	})
+
+	return r, version, err
+}
+
+// ListBackupFiles implements archiving.StorageProvider. Listing is not retried
+// once fn was called, since fn would see backup files more than once.
+func (p retryingStorageProvider) ListBackupFiles(fn func(archiving.BackupFileInfo) error) error {
+	return p.retry("list backup files", func() error {
+		called := false
+		err := p.inner.ListBackupFiles(func(info archiving.BackupFileInfo) error {
+			called = true
+			return fn(info)
+		})
+
+		if nil != err && called {
+			// Not wrapping the error makes sure it's not considered transient.
+			return fmt.Errorf("listing backup files failed: %v", err)
+		}
+
+		return err
+	})
+}
+
+// ListIndexShards implements archiving.StorageProvider.
+func (p retryingStorageProvider) ListIndexShards() (map[string]archiving.Version, error) {
+	var shards map[string]archiving.Version
+	err := p.retry("list index shards", func() error {
+		var err error
+		shards, err = p.inner.ListIndexShards()
+		return err
+	})
+
+	return shards, err
+}
+
+// ReadRunRecord implements archiving.StorageProvider.
+func (p retryingStorageProvider) ReadRunRecord(id string) (io.ReadCloser, error) {
+	return p.retryRead("read run record", func() (io.ReadCloser, error) {
+		return p.inner.ReadRunRecord(id)
+	})
+}
+
+// ListRunRecords implements archiving.StorageProvider.
+func (p retryingStorageProvider) ListRunRecords() ([]string, error) {
+	var ids []string
+	err := p.retry("list run records", func() error {
+		var err error
+		ids, err = p.inner.ListRunRecords()
+		return err
+	})
+
+	return ids, err
+}
+
+// ReadSettings implements archiving.StorageProvider.
+func (p retryingStorageProvider) ReadSettings() (io.ReadCloser, error) {
+	return p.retryRead("read settings", p.inner.ReadSettings)
+}
+
+// WriteBackupFile implements archiving.StorageProvider.
+func (p retryingStorageProvider) WriteBackupFile(entry domain.Entry, r io.ReadSeeker) error {
+	return p.retry("write backup file", func() error {
+		// A previous attempt may have consumed (parts of) the data already.
+		if _, err := r.Seek(0, io.SeekStart); nil != err {
+			return err
+		}
+
+		return p.inner.WriteBackupFile(entry, r)
+	})
+}
+
+// AcquireLock implements archiving.StorageProvider. When a failed attempt
+// acquired the lock although its reply was lost, the next attempt finds the
+// lock held by the same owner; that lock is broken and acquired again.
+func (p retryingStorageProvider) AcquireLock(owner string) (archiving.Lock, error) {
+	var lock archiving.Lock
+	failed := false
+	err := p.retry("acquire lock", func() error {
+		var err error
+		lock, err = p.inner.AcquireLock(owner)
+
+		var lockedErr archiving.LockedError
+		if failed && errors.As(err, &lockedErr) && owner == lockedErr.Owner {
+			glog.Warning("A failed attempt acquired the archive lock; acquiring it again.")
+			if err = p.inner.BreakLock(); nil == err {
+				lock, err = p.inner.AcquireLock(owner)
+			}
+		}
+		failed = nil != err
+
+		return err
+	})
+
+	return lock, err
+}
+
+// BreakLock implements archiving.StorageProvider.
+func (p retryingStorageProvider) BreakLock() error {
+	return p.retry("break lock", p.inner.BreakLock)
+}
+
+func (p retryingStorageProvider) retryRead(
+	operation string,
+	fn func() (io.ReadCloser, error),
+) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := p.retry(operation, func() error {
+		var err error
+		r, err = fn()
+		return err
+	})
+
+	return r, err
+}
+
+func (p retryingStorageProvider) retry(operation string, fn func() error) error {
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if err = fn(); nil == err {
+			return nil
+		}
+
+		if attempt >= p.options.Attempts || !isTransient(err) {
+			return err
+		}
+
+		delay := p.delay(attempt, err)
+		glog.Warningf("Attempt %d/%d to %s failed, retrying in %v: %v",
+			attempt, p.options.Attempts, operation, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.options.Stop:
+			timer.Stop()
+			return fmt.Errorf("stopped retrying to %s: %w", operation, err)
+		}
+	}
+}
+
+// delay calculates the delay before the next attempt, after the given number of
+// failed attempts.
+func (p retryingStorageProvider) delay(attempt int, err error) time.Duration {
+	delay := p.options.InitialDelay << (attempt - 1)
+	if delay <= 0 || (p.options.MaxDelay > 0 && delay > p.options.MaxDelay) {
+		delay = p.options.MaxDelay
+	}
+
+	// Add some jitter so concurrent workers don't retry in lock step.
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	var transientErr archiving.TransientError
+	if errors.As(err, &transientErr) && transientErr.RetryAfter > delay {
+		delay = transientErr.RetryAfter
+	}
+
+	return delay
+}
+
+func isTransient(err error) bool {
+	var transientErr archiving.TransientError
+	if errors.As(err, &transientErr) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
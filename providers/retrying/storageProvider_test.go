@@ -0,0 +1,339 @@
+package retrying
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rokeller/bart/archiving"
+)
+
+var (
+	errTest      = errors.New("test failure")
+	errTransient = archiving.TransientError{Err: errTest}
+)
+
+// fakeProvider is a StorageProvider whose operations fail as scripted. Only
+// the operations used by the tests are implemented.
+type fakeProvider struct {
+	archiving.StorageProvider
+
+	// errs are returned by the calls of ReadSettings, one after the other;
+	// further calls succeed.
+	errs  []error
+	calls int
+
+	// holder is the owner holding the lock, if any.
+	holder string
+	// lostReplies is the number of lock acquisitions and index writes that
+	// succeed, but fail as if their reply was lost.
+	lostReplies int
+	breaks      int
+
+	index   []byte
+	version int
+}
+
+func (p *fakeProvider) ReadSettings() (io.ReadCloser, error) {
+	p.calls++
+	if p.calls <= len(p.errs) {
+		return nil, p.errs[p.calls-1]
+	}
+
+	return io.NopCloser(&bytes.Buffer{}), nil
+}
+
+// lostReply determines if the reply of a successful operation is to be lost.
+func (p *fakeProvider) lostReply() bool {
+	if p.lostReplies > 0 {
+		p.lostReplies--
+		return true
+	}
+
+	return false
+}
+
+func (p *fakeProvider) AcquireLock(owner string) (archiving.Lock, error) {
+	p.calls++
+	if "" != p.holder {
+		return nil, archiving.LockedError{Owner: p.holder}
+	}
+
+	p.holder = owner
+	if p.lostReply() {
+		return nil, errTransient
+	}
+
+	return fakeLock{}, nil
+}
+
+func (p *fakeProvider) BreakLock() error {
+	p.breaks++
+	p.holder = ""
+
+	return nil
+}
+
+func (p *fakeProvider) NewIndexWriter(shard string, expected archiving.Version) (archiving.VersionedWriteCloser, error) {
+	return &fakeIndexWriter{p: p}, nil
+}
+
+func (p *fakeProvider) ReadIndex(shard string) (io.ReadCloser, archiving.Version, error) {
+	if nil == p.index {
+		return nil, "", archiving.IndexNotFound
+	}
+
+	return io.NopCloser(bytes.NewReader(p.index)), p.currentVersion(), nil
+}
+
+func (p *fakeProvider) currentVersion() archiving.Version {
+	return archiving.Version(fmt.Sprintf("v%d", p.version))
+}
+
+type fakeLock struct{}
+
+func (fakeLock) Release() error { return nil }
+func (fakeLock) Err() error     { return nil }
+
+// fakeIndexWriter creates the index, and fails if it exists already.
+type fakeIndexWriter struct {
+	bytes.Buffer
+	p       *fakeProvider
+	version archiving.Version
+}
+
+func (w *fakeIndexWriter) Close() error {
+	if nil != w.p.index {
+		return archiving.IndexConflict
+	}
+
+	w.p.index = w.Bytes()
+	w.p.version++
+	w.version = w.p.currentVersion()
+	if w.p.lostReply() {
+		return errTransient
+	}
+
+	return nil
+}
+
+func (w *fakeIndexWriter) Version() archiving.Version {
+	return w.version
+}
+
+// timeoutError is a net.Error.
+type timeoutError struct {
+	timeout bool
+}
+
+func (e timeoutError) Error() string   { return "network failure" }
+func (e timeoutError) Timeout() bool   { return e.timeout }
+func (e timeoutError) Temporary() bool { return false }
+
+func newTestProvider(p *fakeProvider, attempts int) retryingStorageProvider {
+	return NewRetryingStorageProvider(p, Options{
+		Attempts:     attempts,
+		InitialDelay: time.Microsecond,
+		MaxDelay:     time.Millisecond,
+	}).(retryingStorageProvider)
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"transient error", errTransient, true},
+		{"wrapped transient error", fmt.Errorf("reading: %w", errTransient), true},
+		{"network timeout", timeoutError{timeout: true}, true},
+		{"other network error", timeoutError{timeout: false}, false},
+		{"deadline exceeded", fmt.Errorf("reading: %w", context.DeadlineExceeded), true},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"index conflict", archiving.IndexConflict, false},
+		{"archive locked", archiving.LockedError{Owner: "someone"}, false},
+		{"other error", errTest, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransient(test.err); got != test.want {
+				t.Errorf("isTransient(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  Options
+		attempt  int
+		err      error
+		min, max time.Duration
+	}{
+		{"first retry", Options{InitialDelay: time.Second, MaxDelay: time.Minute}, 1, errTest, 500 * time.Millisecond, time.Second},
+		{"doubled", Options{InitialDelay: time.Second, MaxDelay: time.Minute}, 3, errTest, 2 * time.Second, 4 * time.Second},
+		{"capped", Options{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 10, errTest, 2500 * time.Millisecond, 5 * time.Second},
+		{"overflow capped", Options{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 100, errTest, 2500 * time.Millisecond, 5 * time.Second},
+		{"retry after", Options{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 1,
+			archiving.TransientError{Err: errTest, RetryAfter: time.Minute}, time.Minute, time.Minute},
+		{"shorter retry after", Options{InitialDelay: time.Second, MaxDelay: 5 * time.Second}, 1,
+			archiving.TransientError{Err: errTest, RetryAfter: time.Millisecond}, 500 * time.Millisecond, time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := retryingStorageProvider{options: test.options}
+			for n := 0; n < 100; n++ {
+				if delay := p.delay(test.attempt, test.err); delay < test.min || delay > test.max {
+					t.Fatalf("delay(%d) = %v, want between %v and %v", test.attempt, delay, test.min, test.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		attempts  int
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 3, 1, nil},
+		{"transient failures", []error{errTransient, errTransient}, 3, 3, nil},
+		{"attempts exhausted", []error{errTransient, errTransient, errTransient}, 3, 3, errTest},
+		{"single attempt", []error{errTransient}, 1, 1, errTest},
+		{"no attempts means one", []error{errTransient}, 0, 1, errTest},
+		{"permanent failure", []error{errTest, errTransient}, 3, 1, errTest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeProvider{errs: test.errs}
+			p := newTestProvider(fake, test.attempts)
+
+			_, err := p.ReadSettings()
+			if !errors.Is(err, test.wantErr) || (nil == test.wantErr && nil != err) {
+				t.Errorf("got error %v, want %v", err, test.wantErr)
+			}
+			if fake.calls != test.wantCalls {
+				t.Errorf("got %d calls, want %d", fake.calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryStopped(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+	fake := &fakeProvider{errs: []error{errTransient, errTransient}}
+	p := NewRetryingStorageProvider(fake, Options{
+		Attempts:     3,
+		InitialDelay: time.Hour,
+		MaxDelay:     time.Hour,
+		Stop:         stop,
+	})
+
+	start := time.Now()
+	if _, err := p.ReadSettings(); !errors.Is(err, errTest) {
+		t.Errorf("got error %v, want %v", err, errTest)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stopping took %v", elapsed)
+	}
+	if 1 != fake.calls {
+		t.Errorf("got %d calls, want 1", fake.calls)
+	}
+}
+
+func TestAcquireLockLostReply(t *testing.T) {
+	fake := &fakeProvider{lostReplies: 1}
+	p := newTestProvider(fake, 3)
+
+	if _, err := p.AcquireLock("me"); nil != err {
+		t.Fatalf("acquiring the lock failed: %v", err)
+	}
+	if 1 != fake.breaks || "me" != fake.holder {
+		t.Errorf("got %d breaks and holder '%s', want 1 break and holder 'me'", fake.breaks, fake.holder)
+	}
+}
+
+func TestAcquireLockHeldByOther(t *testing.T) {
+	fake := &fakeProvider{holder: "someone"}
+	p := newTestProvider(fake, 3)
+
+	_, err := p.AcquireLock("me")
+	var lockedErr archiving.LockedError
+	if !errors.As(err, &lockedErr) || "someone" != lockedErr.Owner {
+		t.Errorf("got error %v, want the lock held by 'someone'", err)
+	}
+	if 0 != fake.breaks || 1 != fake.calls {
+		t.Errorf("got %d breaks and %d calls, want none and 1", fake.breaks, fake.calls)
+	}
+}
+
+func writeIndex(p retryingStorageProvider, data string) (archiving.Version, error) {
+	w, err := p.NewIndexWriter("shard", "")
+	if nil != err {
+		return "", err
+	}
+	if _, err := w.Write([]byte(data)); nil != err {
+		return "", err
+	}
+	if err := w.Close(); nil != err {
+		return "", err
+	}
+
+	return w.Version(), nil
+}
+
+func TestIndexWriteLostReply(t *testing.T) {
+	fake := &fakeProvider{lostReplies: 1}
+	p := newTestProvider(fake, 3)
+
+	version, err := writeIndex(p, "index data")
+	if nil != err {
+		t.Fatalf("writing the index failed: %v", err)
+	}
+	if fake.currentVersion() != version {
+		t.Errorf("got version '%s', want '%s'", version, fake.currentVersion())
+	}
+}
+
+func TestIndexWriteConflict(t *testing.T) {
+	fake := &fakeProvider{index: []byte("other data")}
+	p := newTestProvider(fake, 3)
+
+	if _, err := writeIndex(p, "index data"); !errors.Is(err, archiving.IndexConflict) {
+		t.Errorf("got error %v, want %v", err, archiving.IndexConflict)
+	}
+}
+
+func TestIndexWriteConflictAfterFailure(t *testing.T) {
+	// Another writer created the index after the failed attempt.
+	fake := &fakeProvider{}
+	p := newTestProvider(fake, 3)
+	w, _ := p.NewIndexWriter("shard", "")
+	w.Write([]byte("index data"))
+	bw := w.(*bufferedWriter)
+	newWriter := bw.newWriter
+	attempts := 0
+	bw.newWriter = func() (io.WriteCloser, error) {
+		if attempts++; 1 == attempts {
+			fake.index = []byte("other data")
+			return nil, errTransient
+		}
+		return newWriter()
+	}
+
+	if err := w.Close(); !errors.Is(err, archiving.IndexConflict) {
+		t.Errorf("got error %v, want %v", err, archiving.IndexConflict)
+	}
+}
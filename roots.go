@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rokeller/bart/archiving"
+	"github.com/rokeller/bart/inspection"
+)
+
+// localRoots determines the local directories to back up and/or restore, by
+// the names of their roots: the roots given with -roots, or else -path as the
+// single root with an empty name.
+func localRoots(args commonArguments) map[string]string {
+	if "" == strings.TrimSpace(args.roots) {
+		rootDir, _ := filepath.Abs(os.ExpandEnv(args.localRoot))
+		return map[string]string{"": rootDir}
+	}
+
+	roots, err := parseRoots(args.roots)
+	if nil != err {
+		exitf("Invalid -roots: %v", err)
+	}
+
+	return roots
+}
+
+// parseRoots parses the comma-separated roots given with -roots, as 'name=dir'
+// or just 'dir' to name the root by the directory's base name.
+func parseRoots(s string) (map[string]string, error) {
+	roots := map[string]string{}
+	for _, root := range strings.Split(s, ",") {
+		if root = strings.TrimSpace(root); "" == root {
+			continue
+		}
+
+		name, dir, found := strings.Cut(root, "=")
+		if !found {
+			dir = name
+			name = ""
+		}
+		name, dir = strings.TrimSpace(name), strings.TrimSpace(dir)
+		if "" == dir {
+			return nil, fmt.Errorf("the root '%s' has no directory", root)
+		}
+		dir, err := filepath.Abs(os.ExpandEnv(dir))
+		if nil != err {
+			return nil, fmt.Errorf("invalid root '%s': %v", root, err)
+		}
+		if "" == name {
+			name = filepath.Base(dir)
+		}
+
+		if strings.ContainsAny(name, "/\\") || "." == name || ".." == name {
+			return nil, fmt.Errorf("invalid name '%s' for root '%s'; use 'name=dir' to name it", name, root)
+		} else if _, exists := roots[name]; exists {
+			return nil, fmt.Errorf("the root name '%s' is used more than once; use 'name=dir' to name the roots", name)
+		}
+		roots[name] = dir
+	}
+
+	if len(roots) == 0 {
+		return nil, errors.New("no roots were given")
+	}
+
+	return roots, nil
+}
+
+// newLocalContext creates the local context for the roots of the arguments.
+func newLocalContext(args commonArguments) archiving.LocalContext {
+	roots := localRoots(args)
+	if rootDir, found := roots[""]; found {
+		return archiving.NewLocalContext(rootDir)
+	}
+
+	return archiving.NewMultiRootContext(roots)
+}
+
+// discoverRoots discovers the files of all roots of the arguments, presenting
+// their relative paths in the archive index to the visitor.
+func discoverRoots(args commonArguments, v inspection.Visitor) error {
+	for name, dir := range localRoots(args) {
+		if err := inspection.Discover(dir, rootedVisitor{Visitor: v, root: name}); nil != err {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rootedVisitor visits the files of a named root, prefixing their relative
+// paths with the root.
+type rootedVisitor struct {
+	inspection.Visitor
+	root string
+}
+
+func (v rootedVisitor) VisitDir(path string, d fs.DirEntry) {
+	v.Visitor.VisitDir(archiving.RootedPath(v.root, path), d)
+}
+
+func (v rootedVisitor) VisitFile(path string, f fs.DirEntry) {
+	v.Visitor.VisitFile(archiving.RootedPath(v.root, path), f)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseRoots(t *testing.T) {
+	cwd, err := os.Getwd()
+	if nil != err {
+		t.Fatalf("determining the working directory failed: %v", err)
+	}
+	t.Setenv("BART_TEST_DIR", "/data")
+
+	tests := []struct {
+		name    string
+		roots   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"base names", "/home/me/docs,/srv/photos",
+			map[string]string{"docs": "/home/me/docs", "photos": "/srv/photos"}, false},
+		{"named roots", "d=/home/me/docs, p = /srv/photos",
+			map[string]string{"d": "/home/me/docs", "p": "/srv/photos"}, false},
+		{"relative and cleaned", "work=projects/../work/,tmp",
+			map[string]string{"work": filepath.Join(cwd, "work"), "tmp": filepath.Join(cwd, "tmp")}, false},
+		{"environment variables", "data=$BART_TEST_DIR/x",
+			map[string]string{"data": "/data/x"}, false},
+		{"empty parts are skipped", ",/srv/photos,,",
+			map[string]string{"photos": "/srv/photos"}, false},
+		{"same directory with two names", "a=/srv,b=/srv",
+			map[string]string{"a": "/srv", "b": "/srv"}, false},
+		{"empty name uses the base name", "=/srv", map[string]string{"srv": "/srv"}, false},
+		{"duplicate base names", "/home/me/docs,/home/you/docs", nil, true},
+		{"duplicate names", "x=/a,x=/b", nil, true},
+		{"base name and name", "docs=/a,/home/me/docs", nil, true},
+		{"name with a slash", "a/b=/srv", nil, true},
+		{"name with a backslash", "a\\b=/srv", nil, true},
+		{"dot name", ".=/srv", nil, true},
+		{"dot dot name", "..=/srv", nil, true},
+		{"no directory", "x=", nil, true},
+		{"root directory", "/", nil, true},
+		{"no roots", " , ", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			roots, err := parseRoots(test.roots)
+			if test.wantErr {
+				if nil == err {
+					t.Errorf("parseRoots('%s') = %v, want an error", test.roots, roots)
+				}
+			} else if nil != err || !reflect.DeepEqual(roots, test.want) {
+				t.Errorf("parseRoots('%s') = %v, %v, want %v", test.roots, roots, err, test.want)
+			}
+		})
+	}
+}
+
+func TestLocalRootsFromPath(t *testing.T) {
+	dir := t.TempDir()
+
+	roots := localRoots(commonArguments{localRoot: dir})
+	if !reflect.DeepEqual(roots, map[string]string{"": dir}) {
+		t.Errorf("got roots %v, want the single root '%s'", roots, dir)
+	}
+
+	// -roots overrides -path.
+	roots = localRoots(commonArguments{localRoot: dir, roots: "r=/srv"})
+	if !reflect.DeepEqual(roots, map[string]string{"r": "/srv"}) {
+		t.Errorf("got roots %v, want the root 'r'", roots)
+	}
+}
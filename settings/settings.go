@@ -12,7 +12,9 @@ import (
 )
 
 type Settings struct {
-	salt []byte
+	salt     []byte
+	keyCheck []byte
+	roots    []byte
 }
 
 // NewSettings generates new settings with a new salt etc.
@@ -52,7 +54,9 @@ func NewSettingsFromReader(r io.ReadCloser) (Settings, error) {
 	}
 
 	return Settings{
-		salt: settings.Salt,
+		salt:     settings.Salt,
+		keyCheck: settings.KeyCheck,
+		roots:    settings.Roots,
 	}, nil
 }
 
@@ -60,9 +64,35 @@ func (s Settings) Salt() []byte {
 	return s.salt
 }
 
+// KeyCheck returns the value to verify the key derived from the password with,
+// or nil if the settings don't have it.
+func (s Settings) KeyCheck() []byte {
+	return s.keyCheck
+}
+
+// WithKeyCheck returns a copy of the settings with the given key check.
+func (s Settings) WithKeyCheck(keyCheck []byte) Settings {
+	s.keyCheck = keyCheck
+	return s
+}
+
+// Roots returns the encrypted roots of the archive, or nil if the settings
+// don't have them.
+func (s Settings) Roots() []byte {
+	return s.roots
+}
+
+// WithRoots returns a copy of the settings with the given encrypted roots.
+func (s Settings) WithRoots(roots []byte) Settings {
+	s.roots = roots
+	return s
+}
+
 func (s Settings) Write(w io.Writer) error {
 	settings := &domain.Settings{
-		Salt: s.salt,
+		Salt:     s.salt,
+		KeyCheck: s.keyCheck,
+		Roots:    s.roots,
 	}
 
 	data, err := proto.Marshal(settings)
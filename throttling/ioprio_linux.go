@@ -0,0 +1,41 @@
+//go:build linux
+
+package throttling
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// SetLowIOPriority moves the local disk I/O of the process to the idle
+// scheduling class, so other processes are served first.
+func SetLowIOPriority() error {
+	// I/O priorities are tracked per thread on Linux, and new threads inherit
+	// the priority from the thread creating them.
+	tasks, err := os.ReadDir("/proc/self/task")
+	if nil != err {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if nil != err {
+			continue
+		}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET,
+			ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if 0 != errno {
+			return errno
+		}
+	}
+
+	return nil
+}
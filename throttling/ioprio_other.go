@@ -0,0 +1,13 @@
+//go:build !linux
+
+package throttling
+
+import (
+	"github.com/golang/glog"
+)
+
+// SetLowIOPriority is not supported on this platform and does nothing.
+func SetLowIOPriority() error {
+	glog.Warning("Low I/O priority is not supported on this platform.")
+	return nil
+}
@@ -0,0 +1,131 @@
+package throttling
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting the number of bytes per second. A single
+// Limiter can be shared by multiple goroutines.
+type Limiter struct {
+	bytesPerSecond int64
+	schedule       Schedule
+
+	mutex  sync.Mutex
+	tokens int64
+	last   time.Time
+}
+
+// NewLimiter creates a new Limiter allowing for the given number of bytes per
+// second while the schedule is active. A nil Limiter is returned when the rate
+// is not positive, which means no limit.
+func NewLimiter(bytesPerSecond int64, schedule Schedule) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		bytesPerSecond: bytesPerSecond,
+		schedule:       schedule,
+		tokens:         bytesPerSecond,
+		last:           time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *Limiter) Wait(n int) {
+	if nil == l {
+		return
+	}
+
+	for n > 0 {
+		// Never ask for more than the bucket can hold.
+		chunk := int64(n)
+		if chunk > l.bytesPerSecond {
+			chunk = l.bytesPerSecond
+		}
+
+		l.take(chunk)
+		n -= int(chunk)
+	}
+}
+
+func (l *Limiter) take(n int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for {
+		now := time.Now()
+		if !l.schedule.Active(now) {
+			l.tokens = l.bytesPerSecond
+			l.last = now
+			return
+		}
+
+		l.tokens += int64(now.Sub(l.last).Seconds() * float64(l.bytesPerSecond))
+		if l.tokens > l.bytesPerSecond {
+			l.tokens = l.bytesPerSecond
+		}
+		l.last = now
+
+		if l.tokens >= n {
+			l.tokens -= n
+			return
+		}
+
+		// Wait for the missing tokens while holding the lock, so waiting
+		// goroutines are served one after the other.
+		missing := n - l.tokens
+		time.Sleep(time.Duration(float64(missing) / float64(l.bytesPerSecond) * float64(time.Second)))
+	}
+}
+
+// ParseRate parses a rate in bytes per second, like "500K" or "2M". The
+// suffixes K, M and G denote multiples of 1024. An empty string or "0" means no
+// limit.
+func ParseRate(s string) (int64, error) {
+	return parseBytes(s, "rate")
+}
+
+// ParseSize parses a number of bytes, like "500K" or "2G". The suffixes K, M
+// and G denote multiples of 1024. An empty string means 0.
+func ParseSize(s string) (int64, error) {
+	return parseBytes(s, "size")
+}
+
+func parseBytes(s, kind string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if "" == s {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1 << 10
+	case 'M':
+		multiplier = 1 << 20
+	case 'G':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if nil != err || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid %s '%s'", kind, s)
+	}
+
+	// Values below one byte would silently turn into 0, which means no limit.
+	bytes := int64(value * float64(multiplier))
+	if 0 == bytes && value > 0 {
+		return 0, fmt.Errorf("invalid %s '%s': less than one byte", kind, s)
+	}
+
+	return bytes, nil
+}
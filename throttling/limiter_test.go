@@ -0,0 +1,99 @@
+package throttling
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"  ", 0, false},
+		{"0", 0, false},
+		{"100", 100, false},
+		{"512k", 512 << 10, false},
+		{"2M", 2 << 20, false},
+		{" 1G ", 1 << 30, false},
+		{"1.5K", 1536, false},
+		{"0.5M", 512 << 10, false},
+		{"1.9", 1, false},
+		{"0.5", 0, true},
+		{"0.0001K", 0, true},
+		{"-1", 0, true},
+		{"K", 0, true},
+		{"2T", 0, true},
+		{"abc", 0, true},
+		{"Inf", 0, true},
+		{"NaN", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parseBytes(test.input, "rate")
+			if test.wantErr {
+				if nil == err {
+					t.Errorf("parseBytes('%s') = %d, want an error", test.input, got)
+				}
+			} else if nil != err || got != test.want {
+				t.Errorf("parseBytes('%s') = %d, %v, want %d", test.input, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestNewLimiterWithoutRate(t *testing.T) {
+	if nil != NewLimiter(0, Schedule{}) {
+		t.Error("got a limiter for no limit")
+	}
+
+	// Waiting on no limiter must not block.
+	var l *Limiter
+	l.Wait(1 << 30)
+}
+
+// waitTime measures how long it takes to wait for n bytes.
+func waitTime(l *Limiter, n int) time.Duration {
+	start := time.Now()
+	l.Wait(n)
+
+	return time.Since(start)
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := NewLimiter(100_000, Schedule{})
+
+	// The bucket starts full.
+	if elapsed := waitTime(l, 100_000); elapsed > 50*time.Millisecond {
+		t.Errorf("waiting for a full bucket took %v", elapsed)
+	}
+
+	// Then the bytes must be waited for.
+	if elapsed := waitTime(l, 20_000); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waiting for 20000 bytes at 100000 bytes per second took %v", elapsed)
+	}
+}
+
+func TestLimiterWaitMoreThanBucket(t *testing.T) {
+	l := NewLimiter(100_000, Schedule{})
+
+	// Requests larger than the bucket are served in chunks.
+	if elapsed := waitTime(l, 130_000); elapsed < 250*time.Millisecond || elapsed > time.Second {
+		t.Errorf("waiting for 130000 bytes at 100000 bytes per second took %v", elapsed)
+	}
+}
+
+func TestLimiterWaitOutsideSchedule(t *testing.T) {
+	// The only window starts in two hours.
+	start := time.Now().Add(2 * time.Hour)
+	minute := start.Hour()*60 + start.Minute()
+	schedule := Schedule{windows: []window{{start: minute, end: (minute + 60) % (24 * 60)}}}
+	l := NewLimiter(1_000, schedule)
+
+	if elapsed := waitTime(l, 100_000); elapsed > 50*time.Millisecond {
+		t.Errorf("waiting outside of the schedule took %v", elapsed)
+	}
+}
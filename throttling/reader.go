@@ -0,0 +1,56 @@
+package throttling
+
+import (
+	"io"
+)
+
+type limitedReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+type limitedReadSeeker struct {
+	limitedReader
+	s io.Seeker
+}
+
+// NewReader creates a reader that reads from r no faster than the Limiter
+// allows. The reader r is returned as is when there is no Limiter.
+func NewReader(r io.Reader, l *Limiter) io.Reader {
+	if nil == l {
+		return r
+	}
+
+	return limitedReader{r: r, l: l}
+}
+
+// NewReadSeeker is like NewReader, but keeps the ability to seek.
+func NewReadSeeker(r io.ReadSeeker, l *Limiter) io.ReadSeeker {
+	if nil == l {
+		return r
+	}
+
+	return limitedReadSeeker{
+		limitedReader: limitedReader{r: r, l: l},
+		s:             r,
+	}
+}
+
+// Read implements io.Reader.
+func (r limitedReader) Read(p []byte) (int, error) {
+	// Don't read more than what we'd be allowed in a second, so tokens are
+	// not taken for bytes that aren't read in the end.
+	if int64(len(p)) > r.l.bytesPerSecond {
+		p = p[:r.l.bytesPerSecond]
+	}
+
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r limitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.s.Seek(offset, whence)
+}
@@ -0,0 +1,79 @@
+package throttling
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule defines the times of day during which limits apply. An empty
+// Schedule is always active.
+type Schedule struct {
+	windows []window
+}
+
+// window is a time of day window, in minutes since midnight. Windows where end
+// is before start wrap around midnight.
+type window struct {
+	start int
+	end   int
+}
+
+// ParseSchedule parses a comma separated list of time of day windows, like
+// "08:00-12:00,13:00-18:00".
+func ParseSchedule(s string) (Schedule, error) {
+	schedule := Schedule{}
+	s = strings.TrimSpace(s)
+	if "" == s {
+		return schedule, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.Split(strings.TrimSpace(part), "-")
+		if len(bounds) != 2 {
+			return Schedule{}, fmt.Errorf("invalid schedule window '%s'", part)
+		}
+
+		start, err := parseTimeOfDay(bounds[0])
+		if nil != err {
+			return Schedule{}, err
+		}
+		end, err := parseTimeOfDay(bounds[1])
+		if nil != err {
+			return Schedule{}, err
+		}
+
+		schedule.windows = append(schedule.windows, window{start: start, end: end})
+	}
+
+	return schedule, nil
+}
+
+// Active determines if the schedule is active at the given time.
+func (s Schedule) Active(t time.Time) bool {
+	if len(s.windows) == 0 {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s.windows {
+		if w.start <= w.end {
+			if minute >= w.start && minute < w.end {
+				return true
+			}
+		} else if minute >= w.start || minute < w.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if nil != err {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
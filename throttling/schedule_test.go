@@ -0,0 +1,87 @@
+package throttling
+
+import (
+	"testing"
+	"time"
+)
+
+func timeOfDay(hour, minute int) time.Time {
+	return time.Date(2026, 3, 15, hour, minute, 0, 0, time.Local)
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    []window
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"08:00-12:00", []window{{8 * 60, 12 * 60}}, false},
+		{" 08:00 - 12:00 , 13:30-18:00 ", []window{{8 * 60, 12 * 60}, {13*60 + 30, 18 * 60}}, false},
+		{"22:00-06:00", []window{{22 * 60, 6 * 60}}, false},
+		{"08:00", nil, true},
+		{"08:00-12:00-13:00", nil, true},
+		{"8-12", nil, true},
+		{"25:00-26:00", nil, true},
+		{"08:00-12:00,", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.input)
+			if test.wantErr {
+				if nil == err {
+					t.Errorf("ParseSchedule('%s') = %v, want an error", test.input, schedule.windows)
+				}
+				return
+			}
+
+			if nil != err {
+				t.Fatalf("ParseSchedule('%s') failed: %v", test.input, err)
+			}
+			if len(schedule.windows) != len(test.want) {
+				t.Fatalf("ParseSchedule('%s') = %v, want %v", test.input, schedule.windows, test.want)
+			}
+			for n, w := range schedule.windows {
+				if w != test.want[n] {
+					t.Errorf("ParseSchedule('%s') = %v, want %v", test.input, schedule.windows, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		schedule string
+		at       time.Time
+		want     bool
+	}{
+		{"", timeOfDay(3, 0), true},
+		{"08:00-12:00", timeOfDay(7, 59), false},
+		{"08:00-12:00", timeOfDay(8, 0), true},
+		{"08:00-12:00", timeOfDay(11, 59), true},
+		{"08:00-12:00", timeOfDay(12, 0), false},
+		{"08:00-12:00,13:00-18:00", timeOfDay(12, 30), false},
+		{"08:00-12:00,13:00-18:00", timeOfDay(13, 30), true},
+		// Windows spanning midnight.
+		{"22:00-06:00", timeOfDay(21, 59), false},
+		{"22:00-06:00", timeOfDay(22, 0), true},
+		{"22:00-06:00", timeOfDay(0, 0), true},
+		{"22:00-06:00", timeOfDay(5, 59), true},
+		{"22:00-06:00", timeOfDay(6, 0), false},
+		{"22:00-06:00", timeOfDay(12, 0), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.schedule+"@"+test.at.Format("15:04"), func(t *testing.T) {
+			schedule, err := ParseSchedule(test.schedule)
+			if nil != err {
+				t.Fatalf("ParseSchedule('%s') failed: %v", test.schedule, err)
+			}
+			if got := schedule.Active(test.at); got != test.want {
+				t.Errorf("Active(%s) = %v, want %v", test.at.Format("15:04"), got, test.want)
+			}
+		})
+	}
+}